@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+type ChunkOpener func(h string) (io.ReadCloser, error)
+
+// cachedChunkOpener serves chunks from the cache and falls back to the
+// storage for chunks which are not cached; corrupt cached chunks are
+// replaced with the stored ones
+func cachedChunkOpener(s ChunkStore, c *Cache) ChunkOpener {
+	return func(h string) (io.ReadCloser, error) {
+		r, cacheErr := c.openChunk(h)
+		if cacheErr == nil {
+			return r, nil
+		}
+
+		data, err := s.readChunk(h)
+		if err != nil {
+			return nil, err
+		}
+
+		if isCorruptChunk(cacheErr) {
+			log.Errorf("Cached chunk %s is corrupt, downloading it again", h)
+			if err := c.writeChunk(h, data); err != nil {
+				log.Errorf("Cannot write chunk: %s", err.Error())
+			}
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// storedChunkOpener reads chunks from the storage only
+func storedChunkOpener(s ChunkStore) ChunkOpener {
+	return func(h string) (io.ReadCloser, error) {
+		data, err := s.readChunk(h)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+// chunkReader concatenates chunks, opening each one when it is reached
+type chunkReader struct {
+	hashes []string
+	open   ChunkOpener
+	cur    io.ReadCloser
+}
+
+func newChunkReader(hashes []string, open ChunkOpener) *chunkReader {
+	return &chunkReader{
+		hashes: hashes,
+		open:   open,
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.hashes) == 0 {
+				return 0, io.EOF
+			}
+			f, err := r.open(r.hashes[0])
+			if err != nil {
+				return 0, err
+			}
+			r.cur = f
+			r.hashes = r.hashes[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+type ArchiveWalkFunc func(header *tar.Header, mode os.FileMode, r io.Reader) error
+
+// walkArchive calls f for every entry of the archive stored in the given
+// chunks; mode carries os.ModeDir for directories
+func walkArchive(hashes []string, open ChunkOpener, f ArchiveWalkFunc) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	m, err := readManifest(hashes, open)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return m.walk(open, f)
+	}
+
+	chunks := newChunkReader(hashes, open)
+	defer chunks.Close()
+
+	return walkArchiveStream(chunks, f)
+}
+
+// walkArchiveStream calls f for every entry of a gzip compressed tar stream
+func walkArchiveStream(r io.Reader, f ArchiveWalkFunc) error {
+	gzStream, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	tarStream := tar.NewReader(gzStream)
+
+	for {
+		header, err := tarStream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if header == nil {
+			return fmt.Errorf("Unexpected nil tar header")
+		}
+
+		// archives not built by dcd may name entries ./x or /x
+		header.Name = strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if header.Name == "" {
+			continue
+		}
+
+		mode, err := entryMode(header)
+		if err != nil {
+			return err
+		}
+
+		if err := f(header, mode, tarStream); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entryMode returns the mode of an archive entry; os.ModeDir is set for
+// directories, other entries than directories and regular files are
+// rejected
+func entryMode(header *tar.Header) (os.FileMode, error) {
+	var dir os.FileMode
+	if header.Typeflag == '5' {
+		dir = os.ModeDir
+	} else if header.Typeflag == 0 || header.Typeflag == '0' {
+		dir = 0
+	} else {
+		return 0, fmt.Errorf("Unsupported header: %d", header.Typeflag)
+	}
+
+	return dir | os.FileMode(header.Mode&0777755), nil
+}
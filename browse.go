@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// errStopWalk ends an archive walk early
+var errStopWalk = errors.New("stop walk")
+
+type Entry struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// versionHashes returns the hash list of version, or of the current
+// version if version is empty. The archive is read without the lock; its
+// chunks are checked against their hashes and fetched from the storage if
+// an update removes them from the cache meanwhile.
+func (sys *System) versionHashes(version string) ([]string, error) {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	var hashes []string
+	var err error
+	if version == "" {
+		hashes, err = sys.s.getHashes()
+	} else {
+		hashes, err = sys.s.getVersionHashes(version)
+	}
+	if err != nil {
+		if GetErrorType(err) == UnknownVersion {
+			return nil, err
+		}
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+	return hashes, nil
+}
+
+// Cat writes the content of one file of the stored archive
+func (sys *System) Cat(version string, name string, w io.Writer) error {
+	hashes, err := sys.versionHashes(version)
+	if err != nil {
+		return err
+	}
+
+	name = path.Clean("/" + name)[1:]
+	found := false
+	err = walkArchive(hashes, cachedChunkOpener(sys.s, sys.c), func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		if header.Name != name {
+			return nil
+		}
+		if mode.IsDir() {
+			return NewOperationError(InvalidRequest, fmt.Sprintf("%s is a directory", name))
+		}
+		found = true
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err != nil && err != errStopWalk {
+		if GetErrorType(err) != UnknownErrorType {
+			return err
+		}
+		log.Errorf("Cannot read archive: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	if !found {
+		return NewOperationError(UnknownPath, fmt.Sprintf("No such file: %s", name))
+	}
+	return nil
+}
+
+// List returns the entries of a directory of the stored archive
+func (sys *System) List(version string, dir string) ([]Entry, error) {
+	hashes, err := sys.versionHashes(version)
+	if err != nil {
+		return nil, err
+	}
+
+	dir = path.Clean("/" + dir)[1:]
+	if dir == "" {
+		dir = "."
+	}
+
+	found := dir == "."
+	res := make([]Entry, 0)
+	err = walkArchive(hashes, cachedChunkOpener(sys.s, sys.c), func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		if header.Name == dir {
+			if !mode.IsDir() {
+				return NewOperationError(InvalidRequest, fmt.Sprintf("%s is not a directory", dir))
+			}
+			found = true
+		}
+		if path.Dir(header.Name) == dir {
+			found = true
+			res = append(res, Entry{
+				Path:    header.Name,
+				Mode:    mode,
+				Size:    header.Size,
+				ModTime: header.ModTime,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		if GetErrorType(err) != UnknownErrorType {
+			return nil, err
+		}
+		log.Errorf("Cannot read archive: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	if !found {
+		return nil, NewOperationError(UnknownPath, fmt.Sprintf("No such directory: %s", dir))
+	}
+	return res, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// putLegacy stores files as the current version in the format written
+// before manifests, a gzip compressed tar archive cut in chunks
+func putLegacy(t *testing.T, sys *System, files map[string]string) {
+	data := archive(t, files)
+	hashes := make([]string, 0)
+	for len(data) > 0 {
+		n := 64
+		if n > len(data) {
+			n = len(data)
+		}
+		sum := sha256.Sum256(data[:n])
+		h := hashToStr(sum[:])
+		if err := sys.s.writeChunk(h, data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+		data = data[n:]
+	}
+	if err := sys.s.setHashes("", nil, hashes, CommitInfo{}, func() {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	files := map[string]string{"a": "1", "dir/": "", "dir/b": "2"}
+
+	formats := []struct {
+		name  string
+		store func(*testing.T, *System)
+	}{
+		{"manifest", func(t *testing.T, sys *System) {
+			commitFiles(t, sys, map[string]string{"a": "1", "dir/b": "2"})
+		}},
+		{"legacy", func(t *testing.T, sys *System) {
+			putLegacy(t, sys, files)
+		}},
+	}
+
+	cats := []struct {
+		name string
+		data string
+		err  int
+	}{
+		{"a", "1", UnknownErrorType},
+		{"/dir/b", "2", UnknownErrorType},
+		{"dir/../a", "1", UnknownErrorType},
+		{"dir", "", InvalidRequest},
+		{"c", "", UnknownPath},
+	}
+
+	lists := []struct {
+		dir     string
+		entries []string
+		err     int
+	}{
+		{"", []string{"a", "dir"}, UnknownErrorType},
+		{"/", []string{"a", "dir"}, UnknownErrorType},
+		{"dir", []string{"dir/b"}, UnknownErrorType},
+		{"a", nil, InvalidRequest},
+		{"c", nil, UnknownPath},
+	}
+
+	for _, format := range formats {
+		t.Run(format.name, func(t *testing.T) {
+			sys := newTestSystem(t)
+			format.store(t, sys)
+
+			for _, test := range cats {
+				var buf bytes.Buffer
+				err := sys.Cat("", test.name, &buf)
+				if GetErrorType(err) != test.err {
+					t.Errorf("cat %s: error %v", test.name, err)
+					continue
+				}
+				if buf.String() != test.data {
+					t.Errorf("cat %s: %q, want %q", test.name, buf.String(), test.data)
+				}
+			}
+
+			for _, test := range lists {
+				entries, err := sys.List("", test.dir)
+				if GetErrorType(err) != test.err {
+					t.Errorf("ls %s: error %v", test.dir, err)
+					continue
+				}
+				paths := make([]string, 0)
+				for _, e := range entries {
+					paths = append(paths, e.Path)
+				}
+				sort.Strings(paths)
+				if test.entries != nil && !reflect.DeepEqual(paths, test.entries) {
+					t.Errorf("ls %s: %v, want %v", test.dir, paths, test.entries)
+				}
+			}
+
+			if err := sys.Cat("unknown", "a", &bytes.Buffer{}); GetErrorType(err) != UnknownVersion {
+				t.Errorf("cat of an unknown version: %v", err)
+			}
+		})
+	}
+}
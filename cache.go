@@ -1,29 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
+	"strings"
+	"syscall"
 )
 
+// Cache keeps the chunks of the versions unpacked to workspaces. Several
+// files may share a cache directory; every owner (the file the cache is
+// used for) records the hashes it uses under meta/<owner>/hashes and a
+// chunk is only removed once no owner uses it any longer.
 type Cache struct {
 	CacheDir  string
 	ChunkSize int64
+	Owner     string
 }
 
+// getCachedHashes returns the hashes recorded for the owner, none if it
+// has not recorded any yet
 func (c *Cache) getCachedHashes() ([]string, error) {
-	files, err := ioutil.ReadDir(c.CacheDir)
-	if err != nil {
-		return nil, err
-	}
-	var res = make([]string, 0)
-	for _, fi := range files {
-		if !fi.IsDir() {
-			res = append(res, fi.Name())
-		}
+	hashes, err := c.readOwnerHashes(c.ownerDir(c.Owner))
+	if os.IsNotExist(err) {
+		return make([]string, 0), nil
 	}
-	return res, nil
+	return hashes, err
 }
 
 func (c *Cache) writeChunk(h string, data []byte) error {
@@ -34,10 +40,208 @@ func (c *Cache) removeChunk(h string) error {
 	return os.Remove(path.Join(c.CacheDir, h))
 }
 
+func (c *Cache) hasChunk(h string) bool {
+	_, err := os.Stat(path.Join(c.CacheDir, h))
+	return err == nil
+}
+
+// openChunk returns the cached chunk after checking it against its hash
 func (c *Cache) openChunk(h string) (io.ReadCloser, error) {
-	return os.Open(path.Join(c.CacheDir, h))
+	data, err := ioutil.ReadFile(path.Join(c.CacheDir, h))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChunk(h, data); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
 }
 
+// initCache creates the cache directory. A cache written before owners
+// were recorded has no meta directory and belongs to a single file; its
+// chunks are recorded for the owner opening it first.
 func (c *Cache) initCache() error {
-	return os.MkdirAll(c.CacheDir, 0755)
+	if err := os.MkdirAll(c.CacheDir, 0755); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path.Join(c.CacheDir, "meta")); !os.IsNotExist(err) {
+		return err
+	}
+	files, err := ioutil.ReadDir(c.CacheDir)
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, 0)
+	for _, fi := range files {
+		if !fi.IsDir() {
+			hashes = append(hashes, fi.Name())
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	return c.writeOwnerHashes(hashes)
+}
+
+func (c *Cache) ownerDir(owner string) string {
+	return path.Join(c.CacheDir, "meta", url.PathEscape(owner))
+}
+
+func (c *Cache) readOwnerHashes(dir string) ([]string, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, "hashes"))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res, scanner.Err()
+}
+
+func (c *Cache) writeOwnerHashes(hashes []string) error {
+	var buf bytes.Buffer
+	for _, h := range hashes {
+		buf.WriteString(h)
+		buf.WriteString("\n")
+	}
+	return c.writeMeta("hashes", buf.Bytes())
+}
+
+// lock serializes changes of the owner lists and chunk removal of all
+// daemons sharing the cache directory
+func (c *Cache) lock() (*os.File, error) {
+	if err := os.MkdirAll(path.Join(c.CacheDir, "meta"), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path.Join(c.CacheDir, "meta", "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *Cache) unlock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// claimChunks adds hashes to the chunks used by the owner so that they are
+// not removed on behalf of another owner while they are being downloaded
+// and unpacked
+func (c *Cache) claimChunks(hashes []string) error {
+	l, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer c.unlock(l)
+
+	cached, err := c.getCachedHashes()
+	if err != nil {
+		return err
+	}
+
+	claimed := make(map[string]bool)
+	for _, h := range cached {
+		claimed[h] = true
+	}
+	for _, h := range hashes {
+		if !claimed[h] {
+			claimed[h] = true
+			cached = append(cached, h)
+		}
+	}
+
+	return c.writeOwnerHashes(cached)
+}
+
+// releaseChunks makes hashes the chunks used by the owner and removes the
+// chunks no owner uses any more; it returns the number of removed chunks
+func (c *Cache) releaseChunks(hashes []string) (int, error) {
+	l, err := c.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer c.unlock(l)
+
+	cached, err := c.getCachedHashes()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.writeOwnerHashes(hashes); err != nil {
+		return 0, err
+	}
+
+	used := make(map[string]bool)
+	owners, err := ioutil.ReadDir(path.Join(c.CacheDir, "meta"))
+	if err != nil {
+		return 0, err
+	}
+	for _, fi := range owners {
+		if !fi.IsDir() {
+			continue
+		}
+		ownerHashes, err := c.readOwnerHashes(path.Join(c.CacheDir, "meta", fi.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		for _, h := range ownerHashes {
+			used[h] = true
+		}
+	}
+
+	removed := 0
+	for _, h := range cached {
+		if used[h] {
+			continue
+		}
+		if err := c.removeChunk(h); err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorf("Cannot remove chunk: %s", err.Error())
+			}
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// meta files keep state about the workspace of the owner next to the
+// cached chunks
+func (c *Cache) metaPath(name string) string {
+	return path.Join(c.ownerDir(c.Owner), name)
+}
+
+func (c *Cache) openMeta(name string) (io.ReadCloser, error) {
+	return os.Open(c.metaPath(name))
+}
+
+func (c *Cache) writeMeta(name string, data []byte) error {
+	if err := os.MkdirAll(c.ownerDir(c.Owner), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.metaPath(name), data, 0644)
+}
+
+func (c *Cache) removeMeta(name string) error {
+	err := os.Remove(c.metaPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
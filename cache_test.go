@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// cacheChunks writes chunks to the cache and returns their hashes
+func cacheChunks(t *testing.T, c *Cache, data ...string) []string {
+	hashes := make([]string, 0)
+	for _, d := range data {
+		sum := sha256.Sum256([]byte(d))
+		h := hashToStr(sum[:])
+		if err := c.writeChunk(h, []byte(d)); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+func cachedHashes(t *testing.T, c *Cache) []string {
+	hashes, err := c.getCachedHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+func sorted(hashes ...string) []string {
+	res := append([]string{}, hashes...)
+	sort.Strings(res)
+	return res
+}
+
+func TestCacheOwners(t *testing.T) {
+	dir := t.TempDir()
+	a := &Cache{CacheDir: dir, Owner: "/a.tgz"}
+	b := &Cache{CacheDir: dir, Owner: "/b.tgz"}
+	for _, c := range []*Cache{a, b} {
+		if err := c.initCache(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := cacheChunks(t, a, "1", "2", "3")
+	if err := a.claimChunks(h[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if hashes := cachedHashes(t, b); len(hashes) != 0 {
+		t.Errorf("owner without hashes has %v", hashes)
+	}
+	if err := b.claimChunks(h[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := a.releaseChunks(nil); err != nil || n != 1 {
+		t.Errorf("%d chunks released, %v, want 1", n, err)
+	}
+	if a.hasChunk(h[0]) || !a.hasChunk(h[1]) || !a.hasChunk(h[2]) {
+		t.Errorf("chunk used by the other owner removed")
+	}
+	if hashes := cachedHashes(t, b); !reflect.DeepEqual(hashes, sorted(h[1:]...)) {
+		t.Errorf("other owner has %v, want %v", hashes, sorted(h[1:]...))
+	}
+
+	if n, err := b.releaseChunks(nil); err != nil || n != 2 {
+		t.Errorf("%d chunks released, %v, want 2", n, err)
+	}
+}
+
+func TestCacheLegacy(t *testing.T) {
+	dir := t.TempDir()
+	// written before owners were recorded
+	h := cacheChunks(t, &Cache{CacheDir: dir}, "1", "2")
+
+	a := &Cache{CacheDir: dir, Owner: "/a.tgz"}
+	if err := a.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	if hashes := cachedHashes(t, a); !reflect.DeepEqual(hashes, sorted(h...)) {
+		t.Errorf("first owner has %v, want %v", hashes, sorted(h...))
+	}
+
+	b := &Cache{CacheDir: dir, Owner: "/b.tgz"}
+	if err := b.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	if hashes := cachedHashes(t, b); len(hashes) != 0 {
+		t.Errorf("second owner has %v", hashes)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "meta"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("meta holds %d entries, %v", len(files), err)
+	}
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gocql/gocql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CassandraBackend struct {
+	Session  *gocql.Session
+	Keyspace string
+}
+
+func NewCassandraBackend(hosts []string, keyspace string, consistency gocql.Consistency) (*CassandraBackend, error) {
+	cluster := gocql.NewCluster(hosts...)
+	//cluster.DiscoverHosts = true
+	cluster.Timeout = 20 * time.Second
+	cluster.Consistency = consistency
+
+	// the keyspace has to exist before a session can be bound to it
+	if err := initStorage(cluster, keyspace); err != nil {
+		return nil, err
+	}
+
+	cluster.Keyspace = keyspace
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CassandraBackend{
+		Session:  session,
+		Keyspace: keyspace,
+	}, nil
+}
+
+func initStorage(cluster *gocql.ClusterConfig, keyspace string) error {
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err := session.Query("CREATE KEYSPACE IF NOT EXISTS " + keyspace + " WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 3 };").Exec(); err != nil {
+		return err
+	}
+	if err := session.Query(`CREATE TABLE IF NOT EXISTS ` + keyspace + `.files (
+      entryname text,
+		  block     int,
+		  data      blob,
+		  hash      text,
+          PRIMARY KEY(entryname, block));`).Exec(); err != nil {
+		return err
+	}
+	if err := session.Query(`CREATE TABLE IF NOT EXISTS ` + keyspace + `.history (
+		  entryname text,
+		  created   timestamp,
+		  version   text,
+		  author    text,
+		  message   text,
+		  parent    text,
+		  hash      text,
+		  target    list<text>,
+		  PRIMARY KEY(entryname, created, version))
+		  WITH CLUSTERING ORDER BY (created DESC, version ASC);`).Exec(); err != nil {
+		return err
+	}
+	// target was added to the history of existing keyspaces later
+	var column string
+	if err := session.Query("SELECT column_name FROM system_schema.columns WHERE keyspace_name=? AND table_name=? AND column_name=?;",
+		keyspace, "history", "target").Scan(&column); err == gocql.ErrNotFound {
+		if err := session.Query(`ALTER TABLE ` + keyspace + `.history ADD target list<text>;`).Exec(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err := session.Query(`CREATE TABLE IF NOT EXISTS ` + keyspace + `.leases (
+		  entryname text,
+		  host      text,
+		  user      text,
+		  expires   timestamp,
+		  PRIMARY KEY(entryname));`).Exec(); err != nil {
+		return err
+	}
+	if err := session.Query(`CREATE TABLE IF NOT EXISTS ` + keyspace + `.pins (
+		  entryname text,
+		  host      text,
+		  version   text,
+		  PRIMARY KEY(entryname, host));`).Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *CassandraBackend) Open(file string, opts StorageOptions) (Storage, error) {
+	return &CassandraStorage{
+		Session:     b.Session,
+		File:        file,
+		Retention:   opts.Retention,
+		Consistency: opts.Consistency,
+	}, nil
+}
+
+func (b *CassandraBackend) Close() {
+	b.Session.Close()
+}
+
+type CassandraStorage struct {
+	Session   *gocql.Session
+	File      string
+	Retention HistoryRetention
+	// Consistency overrides the level of the session unless zero
+	Consistency gocql.Consistency
+}
+
+// query creates a query at the consistency level of the file
+func (s *CassandraStorage) query(stmt string, values ...interface{}) *gocql.Query {
+	q := s.Session.Query(stmt, values...)
+	if s.Consistency != 0 {
+		q = q.Consistency(s.Consistency)
+	}
+	return q
+}
+
+// chunkPrefix starts the entries of chunks shared by all files; chunks of
+// older versions are kept per file as <file>:<hash>
+const chunkPrefix = "chunk:"
+
+// refName returns the entry holding the hash list of a version
+func (s *CassandraStorage) refName(version string) string {
+	return s.File + ":*" + version
+}
+
+func (s *CassandraStorage) getHashes() ([]string, error) {
+	_, hashes, err := s.getHead()
+	return hashes, err
+}
+
+func (s *CassandraStorage) getHead() (string, []string, error) {
+	var hash string
+	res := make([]string, 0)
+	var block int
+
+	// v2: files[entryname=?,block=-1].hash points to a reference to a hash list
+	iter_v2 := s.query("SELECT hash FROM files WHERE entryname=? AND block=?;", s.File, -1).Iter()
+	for iter_v2.Scan(&hash) {
+		if err := iter_v2.Close(); err != nil {
+			return "", nil, err
+		}
+
+		version := strings.TrimPrefix(hash, s.File+":*")
+
+		iter_v2_1 := s.query("SELECT block, hash FROM files WHERE entryname=?;", hash).PageSize(256).Iter()
+		for iter_v2_1.Scan(&block, &hash) {
+			res = set(res, block, hash)
+		}
+		if err := iter_v2_1.Close(); err != nil {
+			return "", nil, err
+		}
+
+		return version, res, nil
+	}
+
+	if err := iter_v2.Close(); err != nil {
+		return "", nil, err
+	}
+
+	// v1: don't use indirect addressing of hash lists
+	iter := s.query("SELECT block, hash FROM files WHERE entryname=?;", s.File).PageSize(256).Iter()
+
+	for iter.Scan(&block, &hash) {
+		res = set(res, block, hash)
+	}
+	if err := iter.Close(); err != nil {
+		return "", nil, err
+	}
+	return "", res, nil
+}
+
+func (s *CassandraStorage) getHeadVersion() (string, error) {
+	var hash string
+	if err := s.query("SELECT hash FROM files WHERE entryname=? AND block=?;", s.File, -1).Scan(&hash); err != nil {
+		if err == gocql.ErrNotFound {
+			// v1 or never committed
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimPrefix(hash, s.File+":*"), nil
+}
+
+func (s *CassandraStorage) getVersionHashes(version string) ([]string, error) {
+	var hash string
+	var block int
+	res := make([]string, 0)
+
+	iter := s.query("SELECT block, hash FROM files WHERE entryname=?;", s.refName(version)).PageSize(256).Iter()
+	for iter.Scan(&block, &hash) {
+		res = set(res, block, hash)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	if len(res) == 0 {
+		return nil, NewOperationError(UnknownVersion, fmt.Sprintf("File %s: Version %s not found", s.File, version))
+	}
+	return res, nil
+}
+
+func (s *CassandraStorage) listVersions() ([]Version, error) {
+	var created time.Time
+	var version string
+	var info CommitInfo
+	res := make([]Version, 0)
+
+	iter := s.query("SELECT created, version, author, message, parent, hash, target FROM history WHERE entryname=?;", s.File).PageSize(256).Iter()
+	for iter.Scan(&created, &version, &info.Author, &info.Message, &info.Parent, &info.Hash, &info.Target) {
+		res = append(res, Version{
+			Version:    version,
+			Time:       created,
+			CommitInfo: info,
+		})
+		info.Target = nil
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *CassandraStorage) setHashes(expected string, oldHashes, hashes []string, info CommitInfo, ph SetHashesProgressCallback) error {
+	now := time.Now()
+	version := strconv.FormatInt(now.UnixNano(), 10)
+	new_ref := s.refName(version)
+
+	// v1 storage (or a new file) has no ref yet
+	old_version := expected == ""
+	old_ref := s.refName(expected)
+
+	if !old_version {
+		// refs written before history was kept are not listed yet
+		if err := s.recordLegacyRef(old_ref); err != nil {
+			log.Errorf("Error recording ref %s in history: %v", old_ref, err)
+			return err
+		}
+		info.Parent = expected
+	}
+
+	newHashes := make(map[string]bool)
+
+	for i := 0; i < len(hashes); i++ {
+		if err := s.query("INSERT INTO files(entryname, block, data, hash) VALUES (?,?,?,?);",
+			new_ref, i, make([]byte, 0), hashes[i]).Exec(); err != nil {
+			orig_err := err
+			s.query("DELETE FROM files WHERE entryname=?;", new_ref).Exec()
+			log.Errorf("Error trying to set block %d to hash %s for ref=%s: %v", i, hashes[i], new_ref, orig_err)
+			return orig_err
+		}
+		ph()
+		newHashes[hashes[i]] = true
+	}
+
+	// swap the ref only if nobody else did since the hash list was read
+	var swap *gocql.Query
+	if old_version {
+		swap = s.query("INSERT INTO files(entryname, block, data, hash) VALUES (?,?,?,?) IF NOT EXISTS;",
+			s.File, -1, make([]byte, 0), new_ref)
+	} else {
+		swap = s.query("UPDATE files SET hash=? WHERE entryname=? AND block=? IF hash=?;",
+			new_ref, s.File, -1, old_ref)
+	}
+	applied, err := swap.SerialConsistency(gocql.Serial).MapScanCAS(make(map[string]interface{}))
+	if err != nil || !applied {
+		s.query("DELETE FROM files WHERE entryname=?;", new_ref).Exec()
+		if err != nil {
+			log.Errorf("Error updating the ref to %s for entryname %s: %v", new_ref, s.File, err)
+			return err
+		}
+		log.Errorf("Ref of entryname %s has been changed concurrently, expected %s", s.File, old_ref)
+		return NewOperationError(CheckoutMismatch, "The file has been changed by another commit")
+	}
+
+	// recorded only once the version is current, a losing commit never
+	// shows up in the history
+	if err := s.query("INSERT INTO history(entryname, created, version, author, message, parent, hash, target) VALUES (?,?,?,?,?,?,?,?);",
+		s.File, now, version, info.Author, info.Message, info.Parent, info.Hash, info.Target).Exec(); err != nil {
+		log.Errorf("Error adding current version %s to the history of %s: %v", version, s.File, err)
+		return err
+	}
+
+	if old_version {
+		for i := len(hashes); i < len(oldHashes); i++ {
+			s.query("DELETE FROM files WHERE entryname=? AND block=?;", s.File, i).Exec()
+			ph()
+		}
+
+		for _, h := range oldHashes {
+			if _, ok := newHashes[h]; !ok {
+				s.query("DELETE FROM files WHERE entryname=?;", s.File+":"+h).Exec()
+				ph()
+			}
+		}
+
+		return nil
+	}
+
+	return s.pruneHistory(now, ph)
+}
+
+// recordLegacyRef adds a ref named by its unix time to the history
+func (s *CassandraStorage) recordLegacyRef(ref string) error {
+	version := strings.TrimPrefix(ref, s.File+":*")
+	secs, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || secs > 1<<32 {
+		// written with history support, already recorded
+		return nil
+	}
+
+	return s.query("INSERT INTO history(entryname, created, version) VALUES (?,?,?);",
+		s.File, time.Unix(secs, 0), version).Exec()
+}
+
+// pruneHistory drops the versions that are no longer retained along with the
+// chunks kept per file only they referenced; shared chunks are left to the
+// garbage collection
+func (s *CassandraStorage) pruneHistory(now time.Time, ph SetHashesProgressCallback) error {
+	versions, err := s.listVersions()
+	if err != nil {
+		log.Errorf("Cannot list history of %s: %v", s.File, err)
+		return err
+	}
+
+	pinned, err := s.pinnedVersions()
+	if err != nil {
+		log.Errorf("Cannot list pinned versions of %s: %v", s.File, err)
+		return err
+	}
+
+	expired := s.Retention.expired(versions, pinned, now)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	expiredSet := make(map[string]bool)
+	for _, v := range expired {
+		expiredSet[v.Version] = true
+	}
+
+	retainedHashes := make(map[string]bool)
+	for _, v := range versions {
+		if expiredSet[v.Version] {
+			continue
+		}
+		hashes, err := s.getVersionHashes(v.Version)
+		if err != nil {
+			log.Errorf("Cannot read version %s of %s: %v", v.Version, s.File, err)
+			return err
+		}
+		for _, h := range hashes {
+			retainedHashes[h] = true
+		}
+	}
+
+	removed := make(map[string]bool)
+	for _, v := range expired {
+		hashes, err := s.getVersionHashes(v.Version)
+		if err != nil && GetErrorType(err) != UnknownVersion {
+			log.Errorf("Cannot read version %s of %s: %v", v.Version, s.File, err)
+			return err
+		}
+
+		s.query("DELETE FROM files WHERE entryname=?;", s.refName(v.Version)).Exec()
+		s.query("DELETE FROM history WHERE entryname=? AND created=? AND version=?;", s.File, v.Time, v.Version).Exec()
+		ph()
+
+		// chunks kept per file by older versions
+		for _, h := range hashes {
+			if !retainedHashes[h] && !removed[h] {
+				s.query("DELETE FROM files WHERE entryname=?;", s.File+":"+h).Exec()
+				removed[h] = true
+				ph()
+			}
+		}
+	}
+
+	return nil
+}
+
+// CollectGarbage marks the hashes of the refs reachable from the current
+// ref (files[entryname=<file>,block=-1]) or the history of a file and
+// sweeps the other refs and chunks. Shared chunks are deleted on condition
+// that they have not been touched since they were read.
+func (b *CassandraBackend) CollectGarbage(grace time.Duration, dryRun bool) (*GCReport, error) {
+	type ref struct {
+		file    string
+		hashes  []string
+		written int64
+	}
+
+	var entryname, hash string
+	var block int
+	var written int64
+
+	limit := time.Now().Add(-grace).UnixNano() / 1000
+	refs := make(map[string]*ref)
+	liveRefs := make(map[string]bool)
+	v1Hashes := make(map[string][]string)
+	sharedChunks := make(map[string]string)
+	sharedWritten := make(map[string]int64)
+	legacyChunks := make(map[string]int64)
+
+	iter := b.Session.Query("SELECT entryname, block, hash, WRITETIME(hash) FROM files;").PageSize(1000).Iter()
+	// file names cannot contain ':', see checkFileName, so the names of refs
+	// and chunks do not clash with them
+	for iter.Scan(&entryname, &block, &hash, &written) {
+		if strings.HasPrefix(entryname, chunkPrefix) {
+			sharedChunks[entryname] = hash
+			sharedWritten[entryname] = written
+		} else if i := strings.LastIndex(entryname, ":*"); i >= 0 {
+			r, ok := refs[entryname]
+			if !ok {
+				r = &ref{file: entryname[:i]}
+				refs[entryname] = r
+			}
+			r.hashes = append(r.hashes, hash)
+			if written > r.written {
+				r.written = written
+			}
+		} else if strings.Contains(entryname, ":") {
+			legacyChunks[entryname] = written
+		} else if block == -1 {
+			liveRefs[hash] = true
+			// hash lists left over from v1 are superseded by the ref
+			v1Hashes[entryname] = nil
+		} else if list, ok := v1Hashes[entryname]; !ok || list != nil {
+			v1Hashes[entryname] = append(list, hash)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	var version string
+	iter = b.Session.Query("SELECT entryname, version FROM history;").PageSize(1000).Iter()
+	for iter.Scan(&entryname, &version) {
+		liveRefs[entryname+":*"+version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	marked := make(map[string]bool)
+	for file, hashes := range v1Hashes {
+		for _, h := range hashes {
+			marked[file+":"+h] = true
+			marked[chunkPrefix+h] = true
+		}
+	}
+	for name, r := range refs {
+		if !liveRefs[name] {
+			continue
+		}
+		for _, h := range r.hashes {
+			marked[r.file+":"+h] = true
+			marked[chunkPrefix+h] = true
+		}
+	}
+
+	report := &GCReport{Deleted: !dryRun}
+
+	for name, r := range refs {
+		if liveRefs[name] {
+			continue
+		}
+		if r.written >= limit {
+			report.Recent++
+			continue
+		}
+		report.Refs++
+		if !dryRun {
+			if err := b.Session.Query("DELETE FROM files WHERE entryname=?;", name).Exec(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	chunkSize := func(entryname string) (int64, error) {
+		var data []byte
+		iter := b.Session.Query("SELECT data FROM files WHERE entryname=? AND block=0;", entryname).Iter()
+		iter.Scan(&data)
+		return int64(len(data)), iter.Close()
+	}
+
+	for name, written := range legacyChunks {
+		if marked[name] {
+			continue
+		}
+		if written >= limit {
+			report.Recent++
+			continue
+		}
+		size, err := chunkSize(name)
+		if err != nil {
+			return nil, err
+		}
+		report.Chunks++
+		report.Bytes += size
+		if !dryRun {
+			if err := b.Session.Query("DELETE FROM files WHERE entryname=?;", name).Exec(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, token := range sharedChunks {
+		if marked[name] {
+			continue
+		}
+		if sharedWritten[name] >= limit {
+			report.Recent++
+			continue
+		}
+		size, err := chunkSize(name)
+		if err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			// a commit may have touched the chunk to reuse it meanwhile
+			applied, err := b.Session.Query("DELETE FROM files WHERE entryname=? AND block=? IF hash=?;", name, 0, token).
+				SerialConsistency(gocql.Serial).MapScanCAS(make(map[string]interface{}))
+			if err != nil {
+				return nil, err
+			}
+			if !applied {
+				report.Recent++
+				continue
+			}
+		}
+		report.Chunks++
+		report.Bytes += size
+	}
+
+	return report, nil
+}
+
+func (s *CassandraStorage) readChunk(h string) ([]byte, error) {
+	log.Debugf("Storage:readChunk(%s)", h)
+	var corrupt error
+	for _, entryname := range []string{chunkPrefix + h, s.File + ":" + h} {
+		var data []byte
+		iter := s.query("SELECT data FROM files WHERE entryname=? AND block=0;", entryname).Iter()
+		found := iter.Scan(&data)
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+		if found {
+			// a good copy kept per file may remain
+			if corrupt = verifyChunk(h, data); corrupt == nil {
+				return data, nil
+			}
+			log.Errorf("Entry %s is corrupt", entryname)
+		}
+	}
+
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return nil, fmt.Errorf("File %s: Chunk %s not found", s.File, h)
+}
+
+func (s *CassandraStorage) writeChunk(h string, data []byte) error {
+	log.Debugf("Storage:writeChunk(%s,%d)", h, len(data))
+	if err := s.query("INSERT INTO files(entryname, block, data, hash) VALUES (?,?,?,?);", chunkPrefix+h, 0, data, "").Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// touchChunk renews the write time the garbage collection goes by and
+// changes the token it deletes on condition of; the update is conditional
+// so that a chunk removed concurrently is not recreated empty
+func (s *CassandraStorage) touchChunk(h string) (bool, error) {
+	token := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return s.query("UPDATE files SET hash=? WHERE entryname=? AND block=? IF EXISTS;", token, chunkPrefix+h, 0).
+		SerialConsistency(gocql.Serial).MapScanCAS(make(map[string]interface{}))
+}
+
+func (s *CassandraStorage) getLease() (*Lease, error) {
+	l := Lease{File: s.File}
+	found := false
+	iter := s.query("SELECT host, user, expires FROM leases WHERE entryname=?;", s.File).Iter()
+	for iter.Scan(&l.Host, &l.User, &l.Expires) {
+		found = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, nil
+	}
+	return &l, nil
+}
+
+// leaseFromCAS builds the lease returned by a lightweight transaction that
+// has not been applied
+func (s *CassandraStorage) leaseFromCAS(existing map[string]interface{}) *Lease {
+	l := &Lease{File: s.File}
+	if v, ok := existing["host"].(string); ok {
+		l.Host = v
+	}
+	if v, ok := existing["user"].(string); ok {
+		l.User = v
+	}
+	if v, ok := existing["expires"].(time.Time); ok {
+		l.Expires = v
+	}
+	return l
+}
+
+func (s *CassandraStorage) acquireLease(l Lease, ttl time.Duration) error {
+	secs := int(ttl.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+	expires := time.Now().Add(time.Duration(secs) * time.Second)
+
+	existing := make(map[string]interface{})
+	applied, err := s.query("INSERT INTO leases(entryname, host, user, expires) VALUES (?,?,?,?) IF NOT EXISTS USING TTL ?;",
+		s.File, l.Host, l.User, expires, secs).SerialConsistency(gocql.Serial).MapScanCAS(existing)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if current := s.leaseFromCAS(existing); current.Host != l.Host {
+		return lockedError(current)
+	}
+
+	existing = make(map[string]interface{})
+	applied, err = s.query("UPDATE leases USING TTL ? SET user=?, expires=? WHERE entryname=? IF host=?;",
+		secs, l.User, expires, s.File, l.Host).SerialConsistency(gocql.Serial).MapScanCAS(existing)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return lockedError(s.leaseFromCAS(existing))
+	}
+	return nil
+}
+
+func (s *CassandraStorage) releaseLease(host string, force bool) error {
+	if force {
+		return s.query("DELETE FROM leases WHERE entryname=?;", s.File).Exec()
+	}
+
+	existing := make(map[string]interface{})
+	applied, err := s.query("DELETE FROM leases WHERE entryname=? IF host=?;", s.File, host).
+		SerialConsistency(gocql.Serial).MapScanCAS(existing)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		if current := s.leaseFromCAS(existing); current.Host != "" {
+			return lockedError(current)
+		}
+	}
+	return nil
+}
+
+func (s *CassandraStorage) setPin(host string, version string) error {
+	if version == "" {
+		return s.query("DELETE FROM pins WHERE entryname=? AND host=?;", s.File, host).Exec()
+	}
+	return s.query("INSERT INTO pins(entryname, host, version) VALUES (?,?,?);", s.File, host, version).Exec()
+}
+
+func (s *CassandraStorage) pinnedVersions() (map[string]bool, error) {
+	res := make(map[string]bool)
+	var version string
+	iter := s.query("SELECT version FROM pins WHERE entryname=?;", s.File).Iter()
+	for iter.Scan(&version) {
+		res[version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gearTable holds the random values the rolling hash mixes in for every
+// byte; it is generated from a fixed seed so that every node cuts the same
+// content at the same places
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	var x uint64 = 0x2545f4914f6cdd1d
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunker cuts a stream into content-defined chunks (FastCDC): a cut is
+// made where the rolling hash of the last bytes matches a mask, so an edit
+// only changes the chunks around it. Chunks are between avg/4 and avg*4
+// bytes long; the mask is stricter before avg and looser after it to keep
+// the sizes close to avg.
+type chunker struct {
+	r     *bufio.Reader
+	min   int
+	avg   int
+	max   int
+	maskS uint64
+	maskL uint64
+	buf   []byte
+}
+
+// minChunkAvg is the smallest average chunk size; below it the masks would
+// have no bits left
+const minChunkAvg = 64
+
+func newChunker(r io.Reader, avg int) *chunker {
+	if avg < minChunkAvg {
+		avg = minChunkAvg
+	}
+	bits := uint(0)
+	for (1 << (bits + 1)) <= avg {
+		bits++
+	}
+	return &chunker{
+		r:     bufio.NewReaderSize(r, 4*avg),
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 4,
+		maskS: spreadMask(bits + 2),
+		maskL: spreadMask(bits - 2),
+		buf:   make([]byte, 0, avg*4),
+	}
+}
+
+// spreadMask returns a mask with the given number of bits set, spread over
+// the upper part of the word where the gear hash mixes best
+func spreadMask(bits uint) uint64 {
+	var m uint64
+	for i := uint(0); i < bits; i++ {
+		m |= 1 << (63 - 2*i)
+	}
+	return m
+}
+
+// next returns the next chunk; the slice is only valid until the next call
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var fp uint64
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+
+		n := len(c.buf)
+		if n < c.min {
+			continue
+		}
+		fp = (fp << 1) + gearTable[b]
+		if n < c.avg {
+			if fp&c.maskS == 0 {
+				break
+			}
+		} else if fp&c.maskL == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// compressChunk gzips a chunk on its own; the header carries no name or
+// time so that equal content always compresses to the same chunk.
+// Concatenated chunks form a multi-member gzip stream, which reads back as
+// one archive.
+func compressChunk(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
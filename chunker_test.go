@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunks(t *testing.T, data []byte, avg int) [][]byte {
+	c := newChunker(bytes.NewReader(data), avg)
+	res := make([][]byte, 0)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, append([]byte{}, chunk...))
+	}
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func TestChunkerSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		avg  int
+		min  int
+		max  int
+	}{
+		{"random", randomData(1 << 20), 4096, 1024, 16384},
+		{"zeros", make([]byte, 1<<18), 4096, 1024, 16384},
+		{"small avg", randomData(1 << 16), 1, minChunkAvg / 4, minChunkAvg * 4},
+		{"avg 3", randomData(1 << 16), 3, minChunkAvg / 4, minChunkAvg * 4},
+		{"zero avg", randomData(1 << 12), 0, minChunkAvg / 4, minChunkAvg * 4},
+		{"short", randomData(100), 4096, 0, 16384},
+		{"empty", nil, 4096, 0, 0},
+	}
+	for _, test := range tests {
+		res := chunks(t, test.data, test.avg)
+		if !bytes.Equal(bytes.Join(res, nil), test.data) {
+			t.Errorf("%s: chunks do not add up to the data", test.name)
+		}
+		for i, chunk := range res {
+			last := i == len(res)-1
+			if len(chunk) > test.max || (!last && len(chunk) < test.min) {
+				t.Errorf("%s: chunk %d of %d has %d bytes, want %d to %d", test.name, i, len(res), len(chunk), test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestChunkerStableAfterInsert(t *testing.T) {
+	data := randomData(1 << 20)
+	edited := make([]byte, 0, len(data)+16)
+	edited = append(edited, data[:len(data)/2]...)
+	edited = append(edited, []byte("sixteen bytes!!!")...)
+	edited = append(edited, data[len(data)/2:]...)
+
+	before := chunks(t, data, 4096)
+	after := chunks(t, edited, 4096)
+
+	seen := make(map[string]bool)
+	for _, chunk := range before {
+		seen[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range after {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	// the insert touches the chunk holding it and maybe its neighbour
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after a 16 byte insert", changed, len(after))
+	}
+	if len(before) < 64 {
+		t.Errorf("%d chunks for 1 MiB at 4 KiB average", len(before))
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -38,21 +39,28 @@ func NewClientUnixSocket(socket string, file string, ph ClientProgressCallback)
 	}
 }
 
-func (c *Client) Get(w io.Writer) error {
+func (c *Client) Get(version string, w io.Writer) error {
 	req, err := http.NewRequest("GET", c.address, nil)
 	if err != nil {
 		return err
 	}
 
+	query := url.Values{}
+	if version != "" {
+		query.Set("version", version)
+	}
+
 	var ph *ClientProgressHandler = nil
 
 	if c.ph != nil {
 		ph = NewClientProgressHandler(c, c.ph)
-		req.URL.RawQuery = "progress=" + ph.Id
+		query.Set("progress", ph.Id)
 		defer ph.StopMonitoring()
 		go ph.MonitorProgress()
 	}
 
+	req.URL.RawQuery = query.Encode()
+
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return err
@@ -112,29 +120,36 @@ func (c *Client) Edit(force bool) error {
 	return nil
 }
 
-func (c *Client) Commit(force bool) error {
+// Commit stores the workspace as the new version; with target set it is
+// only rolled out to the nodes carrying one of the labels
+func (c *Client) Commit(force bool, message string, target string) error {
 	req, err := http.NewRequest("COMMIT", c.address, nil)
 	if err != nil {
 		return err
 	}
 
+	query := url.Values{}
+	if force {
+		query.Set("force", "true")
+	}
+	if message != "" {
+		query.Set("message", message)
+	}
+	if target != "" {
+		query.Set("target", target)
+	}
+
 	var ph *ClientProgressHandler = nil
 
 	if c.ph != nil {
 		ph = NewClientProgressHandler(c, c.ph)
-		if force {
-			req.URL.RawQuery = "progress=" + ph.Id + "&force=true"
-		} else {
-			req.URL.RawQuery = "progress=" + ph.Id
-		}
+		query.Set("progress", ph.Id)
 		defer ph.StopMonitoring()
 		go ph.MonitorProgress()
-	} else {
-		if force {
-			req.URL.RawQuery = "force=true"
-		}
 	}
 
+	req.URL.RawQuery = query.Encode()
+
 	log.Debug("Request: %s %s", req.Method, req.URL.String())
 
 	resp, err := c.client.Do(req)
@@ -196,6 +211,377 @@ func (c *Client) Update(force bool) error {
 	return nil
 }
 
+// Put uploads a gzip compressed tar archive as the new version; with
+// version set it is only accepted if version is still current, target is
+// the same as for Commit
+func (c *Client) Put(r io.Reader, force bool, version string, message string, target string) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "true")
+	}
+	if version != "" {
+		query.Set("version", version)
+	}
+	if message != "" {
+		query.Set("message", message)
+	}
+	if target != "" {
+		query.Set("target", target)
+	}
+	return c.callWithProgress("PUT", query, r)
+}
+
+func (c *Client) Log() ([]Version, error) {
+	resp, err := c.call("LOG", url.Values{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var versions []Version
+	if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+func (c *Client) Rollback(version string, message string) error {
+	query := url.Values{}
+	query.Set("version", version)
+	if message != "" {
+		query.Set("message", message)
+	}
+	return c.callWithProgress("ROLLBACK", query, nil)
+}
+
+// Promote rolls the current version out to all nodes
+func (c *Client) Promote(message string) error {
+	query := url.Values{}
+	if message != "" {
+		query.Set("message", message)
+	}
+	return c.callWithProgress("PROMOTE", query, nil)
+}
+
+// Pin freezes the workspace of the node on version
+func (c *Client) Pin(version string, reason string) error {
+	query := url.Values{}
+	query.Set("version", version)
+	if reason != "" {
+		query.Set("reason", reason)
+	}
+	return c.callWithProgress("PIN", query, nil)
+}
+
+func (c *Client) Unpin() error {
+	return c.callWithProgress("UNPIN", url.Values{}, nil)
+}
+
+// Revert restores the committed contents of the given paths, or of the
+// whole workspace if none are given
+func (c *Client) Revert(paths []string) error {
+	query := url.Values{}
+	for _, p := range paths {
+		query.Add("path", p)
+	}
+	return c.callWithProgress("REVERT", query, nil)
+}
+
+// Cat writes the content of one file of the stored archive
+func (c *Client) Cat(version string, name string, w io.Writer) error {
+	query := url.Values{}
+	query.Set("path", name)
+	if version != "" {
+		query.Set("version", version)
+	}
+
+	resp, err := c.call("CAT", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// List returns the entries of a directory of the stored archive
+func (c *Client) List(version string, dir string) ([]Entry, error) {
+	query := url.Values{}
+	query.Set("path", dir)
+	if version != "" {
+		query.Set("version", version)
+	}
+
+	resp, err := c.call("LS", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var entries []Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (c *Client) Status() (*WorkspaceStatus, error) {
+	resp, err := c.call("STATUS", url.Values{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status WorkspaceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func (c *Client) Diff(w io.Writer) error {
+	resp, err := c.call("DIFF", url.Values{}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Locks lists the edit leases of the file, or of all files if the client
+// has been created without one
+func (c *Client) Locks() ([]Lease, error) {
+	resp, err := c.call("LOCKS", url.Values{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var leases []Lease
+	if err := json.NewDecoder(resp.Body).Decode(&leases); err != nil {
+		return nil, err
+	}
+
+	return leases, nil
+}
+
+// Hooks returns the last run of every hook of the file
+func (c *Client) Hooks() ([]*HookResult, error) {
+	resp, err := c.call("HOOKS", url.Values{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var results []*HookResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Watch calls f with every update applied to the workspace until f fails
+// or the connection is closed
+func (c *Client) Watch(f func(*UpdateEvent) error) error {
+	resp, err := c.call("WATCH", url.Values{}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event UpdateEvent
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("Connection closed by the daemon")
+			}
+			return err
+		}
+		if err := f(&event); err != nil {
+			return err
+		}
+	}
+}
+
+// Repos lists the repos served by the daemon
+func (c *Client) Repos() ([]RepoStatus, error) {
+	resp, err := c.call("REPOS", url.Values{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var repos []RepoStatus
+	if err := json.NewDecoder(resp.Body).Decode(&repos); err != nil {
+		return nil, err
+	}
+
+	return repos, nil
+}
+
+// AddRepo makes the daemon serve the file of the client
+func (c *Client) AddRepo(rc RepoConfig, persist bool) error {
+	body, err := json.Marshal(&rc)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if persist {
+		query.Set("persist", "true")
+	}
+
+	resp, err := c.call("ADD", query, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RemoveRepo makes the daemon stop serving the file of the client
+func (c *Client) RemoveRepo(persist bool) error {
+	query := url.Values{}
+	if persist {
+		query.Set("persist", "true")
+	}
+
+	resp, err := c.call("REMOVE", query, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Fsck checks the stored and cached chunks of the file, or of all files if
+// the client has been created without one
+func (c *Client) Fsck(repair bool) ([]*FsckReport, error) {
+	query := url.Values{}
+	if repair {
+		query.Set("repair", "true")
+	}
+
+	resp, err := c.call("FSCK", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reports []*FsckReport
+	if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// Metrics writes the metrics of all files in the Prometheus text format
+func (c *Client) Metrics(w io.Writer) error {
+	resp, err := c.call("METRICS", url.Values{}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// GC runs the garbage collection of the storage; with dryRun set it only
+// reports what would be deleted
+func (c *Client) GC(dryRun bool) (*GCReport, error) {
+	query := url.Values{}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+
+	resp, err := c.call("GC", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var report GCReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+func (c *Client) Unlock(force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "true")
+	}
+
+	resp, err := c.call("UNLOCK", query, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// call sends a request for the file and turns non-200 responses into errors
+func (c *Client) call(method string, query url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.address, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.URL.RawQuery = query.Encode()
+
+	log.Debugf("Request: %s %s", req.Method, req.URL.String())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, getError(resp)
+	}
+
+	return resp, nil
+}
+
+// callWithProgress sends a request to an operation reporting its progress
+// through the progress callback of the client
+func (c *Client) callWithProgress(method string, query url.Values, body io.Reader) error {
+	var ph *ClientProgressHandler = nil
+
+	if c.ph != nil {
+		ph = NewClientProgressHandler(c, c.ph)
+		query.Set("progress", ph.Id)
+		defer ph.StopMonitoring()
+		go ph.MonitorProgress()
+	}
+
+	resp, err := c.call(method, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if ph != nil {
+		ph.StopMonitoring()
+		ph.ReportProgress(resp)
+	}
+
+	return nil
+}
+
 func (c *Client) GetProgressFromResp(resp *http.Response) (*ProgressHandler, error) {
 	if resp.Header.Get("content-type") == "application/json" {
 		msg, err := ioutil.ReadAll(resp.Body)
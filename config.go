@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gocql/gocql"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration file of the daemon, read at startup and again
+// on SIGHUP. It is JSON, TOML or YAML depending on the file extension.
+type Config struct {
+	Repos []RepoConfig `json:"repos" yaml:"repos" toml:"repos"`
+}
+
+// RepoConfig configures a file and its workspace. Settings left empty take
+// the value of the command line flag.
+type RepoConfig struct {
+	File      string `json:"file" yaml:"file" toml:"file"`
+	Workspace string `json:"workspace" yaml:"workspace" toml:"workspace"`
+	Cache     string `json:"cache" yaml:"cache" toml:"cache"`
+	ChunkSize int64  `json:"chunk_size,omitempty" yaml:"chunk_size,omitempty" toml:"chunk_size,omitzero"`
+	// Interval between checks for new versions, e.g. 30s
+	Interval string `json:"interval,omitempty" yaml:"interval,omitempty" toml:"interval,omitempty"`
+	Atomic   *bool  `json:"atomic,omitempty" yaml:"atomic,omitempty" toml:"atomic,omitempty"`
+	// History and HistoryAge, e.g. 720h, override -history and -history-age
+	History    *int   `json:"history,omitempty" yaml:"history,omitempty" toml:"history,omitempty"`
+	HistoryAge string `json:"history_age,omitempty" yaml:"history_age,omitempty" toml:"history_age,omitempty"`
+	// Consistency of Cassandra reads and writes: one, quorum or all
+	Consistency string      `json:"consistency,omitempty" yaml:"consistency,omitempty" toml:"consistency,omitempty"`
+	Labels      []string    `json:"labels,omitempty" yaml:"labels,omitempty" toml:"labels,omitempty"`
+	Validate    []string    `json:"validate,omitempty" yaml:"validate,omitempty" toml:"validate,omitempty"`
+	Hooks       *HookConfig `json:"hooks,omitempty" yaml:"hooks,omitempty" toml:"hooks,omitempty"`
+	// Owner and Group, names or ids, are given the workspace entries
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty" toml:"owner,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty" toml:"group,omitempty"`
+}
+
+type HookConfig struct {
+	PreUpdate   string `json:"pre_update,omitempty" yaml:"pre_update,omitempty" toml:"pre_update,omitempty"`
+	PostUpdate  string `json:"post_update,omitempty" yaml:"post_update,omitempty" toml:"post_update,omitempty"`
+	PostCommit  string `json:"post_commit,omitempty" yaml:"post_commit,omitempty" toml:"post_commit,omitempty"`
+	HealthCheck string `json:"health_check,omitempty" yaml:"health_check,omitempty" toml:"health_check,omitempty"`
+	Timeout     string `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+}
+
+const (
+	defaultChunkSize = 64 << 10
+	minChunkSize     = 4 << 10
+	maxChunkSize     = 4 << 20
+)
+
+// checkChunkSize rejects chunk sizes out of range; zero takes the default
+func checkChunkSize(size int64) error {
+	if size != 0 && (size < minChunkSize || size > maxChunkSize) {
+		return fmt.Errorf("Chunk size %d is out of range, %d to %d", size, minChunkSize, maxChunkSize)
+	}
+	return nil
+}
+
+// checkFileName rejects file names which the storage cannot tell from the
+// names of its refs and chunks
+func checkFileName(file string) error {
+	if strings.Contains(file, ":") {
+		return fmt.Errorf("Invalid file name %s: it must not contain ':'", file)
+	}
+	return nil
+}
+
+// loadConfig reads the configuration file at path
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &config)
+	case ".toml":
+		err = toml.Unmarshal(data, &config)
+	default:
+		err = yaml.UnmarshalStrict(data, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse %s: %s", path, err.Error())
+	}
+
+	for i, rc := range config.Repos {
+		if rc.File == "" || rc.Workspace == "" || rc.Cache == "" {
+			return nil, fmt.Errorf("Repo %d in %s needs a file, a workspace and a cache", i+1, path)
+		}
+		if err := checkFileName(rc.File); err != nil {
+			return nil, fmt.Errorf("Repo %d in %s: %s", i+1, path, err.Error())
+		}
+		if err := checkChunkSize(rc.ChunkSize); err != nil {
+			return nil, fmt.Errorf("Repo %s in %s: %s", rc.File, path, err.Error())
+		}
+	}
+	return &config, nil
+}
+
+// saveConfig writes config to path in the format of its extension; the
+// file is replaced at once
+func saveConfig(path string, config *Config) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		data, err = json.MarshalIndent(config, "", "  ")
+		data = append(data, '\n')
+	case ".toml":
+		var buf bytes.Buffer
+		err = toml.NewEncoder(&buf).Encode(config)
+		data = buf.Bytes()
+	default:
+		data, err = yaml.Marshal(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// parseRepoFlag parses a repo of the -f flag: /file.tgz:/workspace:/cache[:interval]
+func parseRepoFlag(spec string) (RepoConfig, error) {
+	rc := strings.SplitN(spec, ":", 4)
+	if len(rc) < 3 {
+		return RepoConfig{}, fmt.Errorf("Invalid repo configuration: %s", spec)
+	}
+	repo := RepoConfig{
+		File:      rc[0],
+		Workspace: rc[1],
+		Cache:     rc[2],
+	}
+	if len(rc) == 4 {
+		repo.Interval = rc[3]
+	}
+	return repo, nil
+}
+
+func parseConsistency(level string) (gocql.Consistency, error) {
+	switch level {
+	case "quorum":
+		return gocql.Quorum, nil
+	case "one":
+		return gocql.One, nil
+	case "all":
+		return gocql.All, nil
+	}
+	return 0, fmt.Errorf("Unsupported consistency level: %s", level)
+}
+
+// parseOwnership resolves the owner and group of workspace entries, nil if
+// neither is set
+func parseOwnership(owner string, group string) (*Ownership, error) {
+	if owner == "" && group == "" {
+		return nil, nil
+	}
+
+	o := &Ownership{Uid: -1, Gid: -1}
+	if owner != "" {
+		id, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return nil, err
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		o.Uid = id
+	}
+	if group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return nil, err
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		o.Gid = id
+	}
+	return o, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	atomic := true
+	history := 5
+	want := &Config{Repos: []RepoConfig{
+		{File: "/a.tgz", Workspace: "/etc/a", Cache: "/var/cache/a"},
+		{
+			File:       "/b.tgz",
+			Workspace:  "/etc/b",
+			Cache:      "/var/cache/b",
+			ChunkSize:  8192,
+			Interval:   "30s",
+			Atomic:     &atomic,
+			History:    &history,
+			HistoryAge: "720h",
+			Labels:     []string{"canary"},
+			Hooks:      &HookConfig{PostUpdate: "reload"},
+		},
+	}}
+
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"repos.yaml", `
+repos:
+  - file: /a.tgz
+    workspace: /etc/a
+    cache: /var/cache/a
+  - file: /b.tgz
+    workspace: /etc/b
+    cache: /var/cache/b
+    chunk_size: 8192
+    interval: 30s
+    atomic: true
+    history: 5
+    history_age: 720h
+    labels: [canary]
+    hooks:
+      post_update: reload
+`, true},
+		{"repos.json", `{"repos": [
+  {"file": "/a.tgz", "workspace": "/etc/a", "cache": "/var/cache/a"},
+  {"file": "/b.tgz", "workspace": "/etc/b", "cache": "/var/cache/b", "chunk_size": 8192,
+   "interval": "30s", "atomic": true, "history": 5, "history_age": "720h", "labels": ["canary"], "hooks": {"post_update": "reload"}}
+]}`, true},
+		{"repos.toml", `
+[[repos]]
+file = "/a.tgz"
+workspace = "/etc/a"
+cache = "/var/cache/a"
+
+[[repos]]
+file = "/b.tgz"
+workspace = "/etc/b"
+cache = "/var/cache/b"
+chunk_size = 8192
+interval = "30s"
+atomic = true
+history = 5
+history_age = "720h"
+labels = ["canary"]
+[repos.hooks]
+post_update = "reload"
+`, true},
+		{"unknown.yaml", "repos:\n  - file: /a.tgz\n    workspace: /a\n    cache: /c\n    color: red\n", false},
+		{"missing.yaml", "repos:\n  - file: /a.tgz\n    workspace: /a\n", false},
+		{"colon.yaml", "repos:\n  - file: /a:b.tgz\n    workspace: /a\n    cache: /c\n", false},
+		{"small.yaml", "repos:\n  - file: /a.tgz\n    workspace: /a\n    cache: /c\n    chunk_size: 1024\n", false},
+		{"large.yaml", "repos:\n  - file: /a.tgz\n    workspace: /a\n    cache: /c\n    chunk_size: 8388608\n", false},
+		{"broken.json", `{"repos": [`, false},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), test.name)
+		if err := ioutil.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(path)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(config, want) {
+			t.Errorf("%s: loaded %+v, want %+v", test.name, config, want)
+		}
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	config := &Config{Repos: []RepoConfig{
+		{File: "/a.tgz", Workspace: "/etc/a", Cache: "/var/cache/a", Labels: []string{"eu"}},
+		{File: "/b.tgz", Workspace: "/etc/b", Cache: "/var/cache/b", Hooks: &HookConfig{HealthCheck: "check"}},
+	}}
+	for _, name := range []string{"repos.yaml", "repos.json", "repos.toml"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := saveConfig(path, config); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(loaded, config) {
+			t.Errorf("%s: loaded %+v, want %+v", name, loaded, config)
+		}
+	}
+}
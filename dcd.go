@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/gocql/gocql"
 	"github.com/op/go-logging"
 	"github.com/sevlyar/go-daemon"
 )
@@ -26,104 +28,363 @@ var format = logging.MustStringFormatter(
 var (
 	daemonMode = flag.Bool("d", false, "daemon mode")
 	debug      = flag.Bool("v", false, "verbose output")
-	cassandra  = flag.String("db", "localhost", "cassandra endpoint")
+	dbUri      = flag.String("db", "cassandra://localhost/dconf", "storage backend: cassandra://host1,host2/keyspace or file:///path")
 	socket     = flag.String("a", "/run/dcd.socket", "communication socket")
-	repoCfg    = flag.String("f", "", "repo configuration: -f /file.tgz:/workspace:/cache,...")
+	repoCfg    = flag.String("f", "", "repo configuration: -f /file.tgz:/workspace:/cache[:interval],...")
 	//ws          = flag.String("w", "/cfg", "workspace root")
 	force       = flag.Bool("o", false, "overwrite repo contents")
 	consistency = flag.String("c", "quorum", "cassandra consistency level (r/w)")
 	//cacheDir    = flag.String("s", "/.dcdcache", "cache directory")
 	progress = flag.Bool("p", false, "display progress")
+	revision = flag.String("r", "", "version to get; current version expected by put")
+	message  = flag.String("m", "", "commit message")
+	history  = flag.Int("history", 10, "number of versions to keep")
+	maxAge   = flag.Duration("history-age", 0, "keep all versions younger than this")
+	leaseTTL = flag.Duration("lease", 0, "cluster-wide edit lease TTL (0 disables leases)")
+	gcEvery  = flag.Duration("gc-interval", 0, "collect unreachable refs and chunks this often (0 disables)")
+	gcGrace  = flag.Duration("gc-grace", chunkGracePeriod, "keep unreachable refs and chunks younger than this")
+	atomic   = flag.Bool("atomic", false, "unpack updates next to the workspace and switch a symlink to them")
+	labels   = flag.String("labels", "", "labels of this node: -labels canary,eu")
+	target   = flag.String("target", "", "roll a commit out to the nodes with one of these labels only, until promoted")
+
+	preUpdate   = flag.String("pre-update", "", "command run before the workspace is updated; failing cancels the update")
+	postUpdate  = flag.String("post-update", "", "command run after the workspace has been updated")
+	postCommit  = flag.String("post-commit", "", "command run after a new version has been committed")
+	healthCheck = flag.String("health-check", "", "command run after updates; failing restores the previous version")
+	hookTimeout = flag.Duration("hook-timeout", 30*time.Second, "kill hooks and validators running longer than this (0 disables)")
+	notifyAddr  = flag.String("notify-listen", "", "UDP address to receive new version notifications from the peers on: -notify-listen :7070; keep it closed to hosts outside the cluster")
+	notifyPeers = flag.String("notify-peers", "", "daemons to notify about new versions: -notify-peers host1:7070,host2:7070")
+	interval    = flag.Duration("interval", defaultUpdateInterval, "time between checks for new versions, unless set for the repo")
+	maxBackoff  = flag.Duration("max-backoff", defaultMaxBackoff, "longest time between checks after failures")
+	configFile  = flag.String("config", "", "configuration file (json, toml or yaml) holding repos and their settings, re-read on SIGHUP")
 )
 
+// validators collects the -validate flags
+type validators []Validator
+
+func (v *validators) String() string {
+	return ""
+}
+
+func (v *validators) Set(spec string) error {
+	validator, err := parseValidator(spec)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, validator)
+	return nil
+}
+
+var commitValidators validators
+
+func init() {
+	flag.Var(&commitValidators, "validate", "check the workspace before commits: exec:<command> or (json|yaml|toml):<pattern>,... (repeatable)")
+}
+
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s (edit|commit|get|update)\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s (edit|commit|get|update|log|status|diff|hooks|promote|unpin) <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s rollback <file> <version>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s pin [-m reason] <file> <version>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s put [-r version] <file> < archive.tgz\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s revert <file> [path...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s watch <file> [-- command [arg...]]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s cat [-r version] <file> <path>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s ls [-r version] <file> [dir]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s locks [file]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s unlock [-f] <file>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s gc [-n]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s fsck [-repair] [file]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s metrics\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s repos\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s add-repo [-persist] [-interval d] [-atomic] [-c level] [-labels l,...] [hook flags] <file> <workspace> <cache>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s remove-repo [-persist] <file>\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
 func run() {
-	var consistencyLevel gocql.Consistency
-	if *consistency == "quorum" {
-		consistencyLevel = gocql.Quorum
-	} else if *consistency == "one" {
-		consistencyLevel = gocql.One
-	} else if *consistency == "all" {
-		consistencyLevel = gocql.All
-	} else {
-		log.Fatalf("Unsupported consistency level: %s", *consistency)
+	consistencyLevel, err := parseConsistency(*consistency)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	backend, err := OpenStorageBackend(*dbUri, consistencyLevel)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer backend.Close()
 
-	cluster := gocql.NewCluster(*cassandra)
-	//cluster.DiscoverHosts = true
-	cluster.Timeout = 20 * time.Second
-	cluster.Consistency = consistencyLevel
+	retention := HistoryRetention{
+		Keep:   *history,
+		MaxAge: *maxAge,
+	}
 
-	session, _ := cluster.CreateSession()
-	defer session.Close()
+	var notifier *Notifier
+	if *notifyAddr != "" || *notifyPeers != "" {
+		var peers []string
+		if *notifyPeers != "" {
+			peers = strings.Split(*notifyPeers, ",")
+		}
+		notifier, err = NewNotifier(*notifyAddr, peers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer notifier.Close()
+	}
 
-	systems := make(map[string]*System)
+	repos := NewRepos(func(rc RepoConfig) (*System, error) {
+		return openRepo(backend, retention, notifier, rc)
+	}, *configFile)
+	onShutdown(repos.Stop)
 
-	repos := strings.Split(*repoCfg, ",")
-	if repos != nil {
-		for _, repo := range repos {
-			rc := strings.SplitN(repo, ":", 3)
-			if len(rc) != 3 {
-				log.Fatalf("Invalid repo configuration: %s", repo)
-			}
+	configs, err := repoConfigs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := repos.apply(configs); err != nil {
+		log.Fatal(err)
+	}
 
-			s := &Storage{
-				Session: session,
-				File:    rc[0],
-			}
+	if *configFile != "" {
+		var reloading sync.Mutex
+		onReload(func() {
+			// one reload at a time; each reads the file anew
+			reloading.Lock()
+			defer reloading.Unlock()
 
-			if err := s.initStorage(); err != nil {
-				log.Fatal(err)
+			log.Infof("Reloading %s", *configFile)
+			configs, err := repoConfigs()
+			if err != nil {
+				log.Errorf("Cannot reload configuration: %s", err.Error())
+				return
 			}
-
-			w := &Workspace{
-				Root: rc[1],
+			if err := repos.apply(configs); err != nil {
+				log.Errorf("Cannot reload configuration: %s", err.Error())
 			}
+		})
+	}
 
-			c := &Cache{
-				CacheDir:  rc[2],
-				ChunkSize: 65536,
-			}
+	if notifier != nil && *notifyAddr != "" {
+		go notifier.serve(repos)
+	}
 
-			if err := c.initCache(); err != nil {
-				log.Fatal(err)
+	gc := NewCollector(backend, *gcGrace)
+	if *gcEvery > 0 {
+		gc.schedule(*gcEvery)
+	}
+
+	server := NewHttpServerUnixSocket(*socket, repos, gc)
+	defer server.Close()
+	onShutdown(server.Close)
+
+	if err := server.Serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// repoConfigs returns the repos of the -f flag followed by the ones of the
+// configuration file
+func repoConfigs() ([]RepoConfig, error) {
+	configs := make([]RepoConfig, 0)
+	if *repoCfg != "" {
+		for _, spec := range strings.Split(*repoCfg, ",") {
+			rc, err := parseRepoFlag(spec)
+			if err != nil {
+				return nil, err
 			}
+			configs = append(configs, rc)
+		}
+	}
 
-			system := NewSystem(s, c, w)
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config.Repos...)
+	}
+	return configs, nil
+}
 
-			system.runUpdate()
+// openRepo creates the system of a repo; settings the repo leaves empty
+// are taken from the command line
+func openRepo(backend StorageBackend, retention HistoryRetention, notifier *Notifier, rc RepoConfig) (*System, error) {
+	storageOpts := StorageOptions{Retention: retention}
+	if rc.Consistency != "" {
+		level, err := parseConsistency(rc.Consistency)
+		if err != nil {
+			return nil, err
+		}
+		storageOpts.Consistency = level
+	}
 
-			systems[rc[0]] = system
+	if rc.History != nil {
+		if *rc.History < 0 {
+			return nil, fmt.Errorf("Invalid history: %d", *rc.History)
+		}
+		storageOpts.Retention.Keep = *rc.History
+	}
+	if rc.HistoryAge != "" {
+		d, err := time.ParseDuration(rc.HistoryAge)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid history age: %s", rc.HistoryAge)
 		}
+		storageOpts.Retention.MaxAge = d
 	}
 
-	server := NewHttpServerUnixSocket(*socket, systems)
-	defer server.Close()
+	repoInterval := *interval
+	if rc.Interval != "" {
+		d, err := time.ParseDuration(rc.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid interval: %s", rc.Interval)
+		}
+		repoInterval = d
+	}
 
-	if err := server.Serve(); err != nil {
-		log.Fatal(err)
+	hooks := HookConfig{}
+	if rc.Hooks != nil {
+		hooks = *rc.Hooks
+	}
+	hookOpts := HookOptions{
+		PreUpdate:   or(hooks.PreUpdate, *preUpdate),
+		PostUpdate:  or(hooks.PostUpdate, *postUpdate),
+		PostCommit:  or(hooks.PostCommit, *postCommit),
+		HealthCheck: or(hooks.HealthCheck, *healthCheck),
+		Timeout:     *hookTimeout,
+	}
+	if hooks.Timeout != "" {
+		d, err := time.ParseDuration(hooks.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hook timeout: %s", hooks.Timeout)
+		}
+		hookOpts.Timeout = d
+	}
+
+	repoValidators := []Validator(commitValidators)
+	if len(rc.Validate) > 0 {
+		repoValidators = make([]Validator, 0, len(rc.Validate))
+		for _, spec := range rc.Validate {
+			v, err := parseValidator(spec)
+			if err != nil {
+				return nil, err
+			}
+			repoValidators = append(repoValidators, v)
+		}
+	}
+
+	repoLabels := rc.Labels
+	if len(repoLabels) == 0 && *labels != "" {
+		repoLabels = strings.Split(*labels, ",")
+	}
+
+	owner, err := parseOwnership(rc.Owner, rc.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkChunkSize(rc.ChunkSize); err != nil {
+		return nil, err
+	}
+	chunkSize := rc.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	s, err := backend.Open(rc.File, storageOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Workspace{
+		Root:   rc.Workspace,
+		Atomic: *atomic,
+		Owner:  owner,
+	}
+	if rc.Atomic != nil {
+		w.Atomic = *rc.Atomic
 	}
+
+	c := &Cache{
+		CacheDir:  rc.Cache,
+		ChunkSize: chunkSize,
+		Owner:     rc.File,
+	}
+
+	if err := c.initCache(); err != nil {
+		return nil, err
+	}
+
+	return NewSystem(s, c, w, SystemOptions{
+		LeaseTTL:   *leaseTTL,
+		Hooks:      hookOpts,
+		Validators: repoValidators,
+		Labels:     repoLabels,
+		Notifier:   notifier,
+
+		UpdateInterval: repoInterval,
+		MaxBackoff:     *maxBackoff,
+	}), nil
+}
+
+// or returns value unless it is empty
+func or(value string, def string) string {
+	if value != "" {
+		return value
+	}
+	return def
+}
+
+var shutdownLock sync.Mutex
+var shutdownFuncs []func()
+
+// onShutdown registers f to be run before the daemon exits on a signal
+func onShutdown(f func()) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownFuncs = append(shutdownFuncs, f)
+}
+
+var reloadFunc func()
+
+// onReload sets the function run on SIGHUP
+func onReload(f func()) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	reloadFunc = f
+}
+
+// shutdown runs the registered functions, the last registered first
+func shutdown() {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	for i := len(shutdownFuncs) - 1; i >= 0; i-- {
+		shutdownFuncs[i]()
+	}
+	shutdownFuncs = nil
 }
 
 func main() {
 	logging.SetFormatter(format)
 
 	sc := make(chan os.Signal, 1)
-	signal.Notify(sc)
+	// other signals keep their default handling; in particular SIGPIPE from
+	// a client gone away only fails the write to its connection
+	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		for {
 			s := <-sc
 			ssig := s.(syscall.Signal)
-			if ssig == syscall.SIGWINCH {
-				// ignore SIGWINCH (window changed)
-				continue
+			if ssig == syscall.SIGHUP {
+				shutdownLock.Lock()
+				reload := reloadFunc
+				shutdownLock.Unlock()
+				if reload != nil {
+					go reload()
+					continue
+				}
 			}
 			log.Errorf("Signal received: %s", ssig.String())
+			shutdown()
 			os.Exit(128 + int(ssig))
 		}
 	}()
@@ -155,12 +416,28 @@ func main() {
 			run()
 		}
 	} else {
-		if flag.NArg() < 2 {
+		command := flag.Arg(0)
+
+		// flags may follow the command as well; -f is the force flag of
+		// unlock there
+		cmdFlags := flag.NewFlagSet(os.Args[0]+" "+command, flag.ExitOnError)
+		cmdFlags.Usage = Usage
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Name != "f" {
+				cmdFlags.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		breakLease := cmdFlags.Bool("f", false, "break a lease held by another host")
+		dryRun := cmdFlags.Bool("n", false, "only report what gc would delete")
+		repair := cmdFlags.Bool("repair", false, "let fsck repair the problems found")
+		persist := cmdFlags.Bool("persist", false, "let add-repo and remove-repo change the configuration file")
+		cmdFlags.Parse(flag.Args()[1:])
+
+		file := cmdFlags.Arg(0)
+		if file == "" && command != "locks" && command != "gc" && command != "fsck" && command != "metrics" && command != "repos" {
 			Usage()
 			os.Exit(2)
 		}
-		command := flag.Arg(0)
-		file := flag.Arg(1)
 		var ph ClientProgressCallback = nil
 		if *progress {
 			ph = func(progress int64, total int64, final bool) {
@@ -186,7 +463,7 @@ func main() {
 		client := NewClientUnixSocket(*socket, file, ph)
 		switch command {
 		case "get":
-			err := client.Get(os.Stdout)
+			err := client.Get(*revision, os.Stdout)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
@@ -198,7 +475,7 @@ func main() {
 				os.Exit(1)
 			}
 		case "commit":
-			err := client.Commit(*force)
+			err := client.Commit(*force, *message, *target)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
@@ -209,6 +486,321 @@ func main() {
 				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 				os.Exit(1)
 			}
+		case "put":
+			err := client.Put(os.Stdin, *force, *revision, *message, *target)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "log":
+			versions, err := client.Log()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			for _, v := range versions {
+				fmt.Printf("version %s\n", v.Version)
+				if v.Author != "" {
+					fmt.Printf("Author: %s\n", v.Author)
+				}
+				fmt.Printf("Date:   %s\n", v.Time.Local().Format("2006-01-02 15:04:05 -0700"))
+				if v.Parent != "" {
+					fmt.Printf("Parent: %s\n", v.Parent)
+				}
+				if v.Hash != "" {
+					fmt.Printf("Hash:   %s\n", v.Hash)
+				}
+				if len(v.Target) > 0 {
+					fmt.Printf("Target: %s\n", strings.Join(v.Target, ","))
+				}
+				if v.Message != "" {
+					fmt.Printf("\n    %s\n", strings.Replace(v.Message, "\n", "\n    ", -1))
+				}
+				fmt.Println()
+			}
+		case "rollback":
+			if cmdFlags.NArg() < 2 {
+				Usage()
+				os.Exit(2)
+			}
+			err := client.Rollback(cmdFlags.Arg(1), *message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "promote":
+			err := client.Promote(*message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "pin":
+			if cmdFlags.NArg() < 2 {
+				Usage()
+				os.Exit(2)
+			}
+			err := client.Pin(cmdFlags.Arg(1), *message)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "unpin":
+			err := client.Unpin()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "revert":
+			err := client.Revert(cmdFlags.Args()[1:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "cat":
+			if cmdFlags.NArg() < 2 {
+				Usage()
+				os.Exit(2)
+			}
+			err := client.Cat(*revision, cmdFlags.Arg(1), os.Stdout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "ls":
+			entries, err := client.List(*revision, cmdFlags.Arg(1))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			for _, e := range entries {
+				fmt.Printf("%s %10d %s %s\n", e.Mode, e.Size, e.ModTime.Local().Format("2006-01-02 15:04:05"), path.Base(e.Path))
+			}
+		case "status":
+			status, err := client.Status()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			if status.CheckedOut {
+				fmt.Printf("Checked out from version %s\n", status.Version)
+			} else {
+				fmt.Printf("Not checked out, version %s\n", status.Version)
+			}
+			if status.Pin != nil {
+				fmt.Printf("Pinned by %s at %s", status.Pin.User, status.Pin.Time.Local().Format("2006-01-02 15:04:05"))
+				if status.Pin.Reason != "" {
+					fmt.Printf(": %s", status.Pin.Reason)
+				}
+				fmt.Println()
+				if status.PinPruned {
+					fmt.Printf("Pinned version %s is no longer retained, the workspace is left alone until unpinned\n", status.Pin.Version)
+				}
+			}
+			if status.Head != "" {
+				fmt.Printf("Current version %s is not rolled out to this node\n", status.Head)
+			}
+			for _, c := range status.Changes {
+				fmt.Printf("%-9s %s\n", c.Status, c.Path)
+			}
+			if h := status.Health; h != nil {
+				fmt.Printf("Health checks: %d run, %d failed, %d restores\n", h.Checks, h.Failures, h.Restores)
+				for _, hash := range h.Bad {
+					fmt.Printf("Bad version %s\n", hash)
+				}
+			}
+			if u := status.Update; u != nil {
+				if u.LastSuccess != nil {
+					fmt.Printf("Last update check %s, every %s\n", u.LastSuccess.Local().Format("2006-01-02 15:04:05"), u.Interval)
+				}
+				if u.Failures > 0 {
+					fmt.Printf("Update check failed %d times in a row, last at %s: %s\n", u.Failures, u.LastErrorTime.Local().Format("2006-01-02 15:04:05"), u.LastError)
+				}
+			}
+		case "diff":
+			err := client.Diff(os.Stdout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "locks":
+			leases, err := client.Locks()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			for _, l := range leases {
+				fmt.Printf("%s\t%s@%s\t%s\n", l.File, l.User, l.Host, l.Expires.Local().Format("2006-01-02 15:04:05"))
+			}
+		case "unlock":
+			err := client.Unlock(*breakLease || *force)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "fsck":
+			reports, err := client.Fsck(*repair)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			clean := true
+			for _, r := range reports {
+				fmt.Printf("%s: %d versions, %d chunks, %d cached\n", r.File, r.Versions, r.Chunks, r.Cached)
+				for _, h := range r.Missing {
+					fmt.Printf("  missing chunk %s\n", h)
+				}
+				for _, h := range r.Corrupt {
+					fmt.Printf("  corrupt chunk %s\n", h)
+				}
+				for _, h := range r.CacheCorrupt {
+					fmt.Printf("  corrupt cached chunk %s\n", h)
+				}
+				for _, v := range r.Broken {
+					fmt.Printf("  cannot read version %s\n", v)
+				}
+				for _, h := range r.Repaired {
+					fmt.Printf("  repaired chunk %s\n", h)
+				}
+				clean = clean && r.Clean()
+			}
+			if !clean {
+				os.Exit(1)
+			}
+		case "hooks":
+			results, err := client.Hooks()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			for _, r := range results {
+				status := fmt.Sprintf("exit %d", r.ExitCode)
+				if r.Error != "" {
+					status = r.Error
+				}
+				fmt.Printf("%-12s %s  %s (%s)\n", r.Hook, r.Started.Local().Format("2006-01-02 15:04:05"), status, r.Duration)
+				if r.Output != "" {
+					fmt.Printf("    %s\n", strings.Replace(strings.TrimRight(r.Output, "\n"), "\n", "\n    ", -1))
+				}
+			}
+		case "watch":
+			// without a command the events are printed
+			args := cmdFlags.Args()[1:]
+			if len(args) > 0 && args[0] == "--" {
+				args = args[1:]
+			}
+			err := client.Watch(func(event *UpdateEvent) error {
+				if len(args) == 0 {
+					fmt.Printf("%s %s -> %s\n", event.Time.Local().Format("2006-01-02 15:04:05"), event.OldHash, event.NewHash)
+					for _, p := range event.Changed {
+						fmt.Printf("    %s\n", p)
+					}
+					return nil
+				}
+				if err := runOnEvent(args, event); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", strings.Join(args, " "), err.Error())
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "metrics":
+			err := client.Metrics(os.Stdout)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "repos":
+			repos, err := client.Repos()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			for _, r := range repos {
+				fmt.Printf("%s %s %s", r.Config.File, r.Config.Workspace, r.Config.Cache)
+				if r.Added {
+					fmt.Printf(" (not persisted)")
+				}
+				fmt.Println()
+				if u := r.Update; u != nil && u.Failures > 0 {
+					fmt.Printf("    update check failed %d times in a row: %s\n", u.Failures, u.LastError)
+				}
+			}
+		case "add-repo":
+			if cmdFlags.NArg() != 3 {
+				Usage()
+				os.Exit(2)
+			}
+			rc := RepoConfig{File: file}
+			var err error
+			// the daemon does not share the working directory
+			if rc.Workspace, err = filepath.Abs(cmdFlags.Arg(1)); err == nil {
+				rc.Cache, err = filepath.Abs(cmdFlags.Arg(2))
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			// only the settings given are sent, the daemon has defaults
+			hooks := HookConfig{}
+			cmdFlags.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "interval":
+					rc.Interval = f.Value.String()
+				case "atomic":
+					rc.Atomic = atomic
+				case "c":
+					rc.Consistency = *consistency
+				case "labels":
+					rc.Labels = strings.Split(*labels, ",")
+				case "validate":
+					for _, v := range commitValidators {
+						rc.Validate = append(rc.Validate, v.String())
+					}
+				case "pre-update":
+					hooks.PreUpdate = *preUpdate
+				case "post-update":
+					hooks.PostUpdate = *postUpdate
+				case "post-commit":
+					hooks.PostCommit = *postCommit
+				case "health-check":
+					hooks.HealthCheck = *healthCheck
+				case "hook-timeout":
+					hooks.Timeout = f.Value.String()
+				}
+			})
+			if hooks != (HookConfig{}) {
+				rc.Hooks = &hooks
+			}
+			err = client.AddRepo(rc, *persist)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "remove-repo":
+			err := client.RemoveRepo(*persist)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+		case "gc":
+			report, err := client.GC(*dryRun)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				os.Exit(1)
+			}
+			action := "Deleted"
+			if !report.Deleted {
+				action = "Unreachable"
+			}
+			fmt.Printf("%s: %d refs, %d chunks (%d bytes)\n", action, report.Refs, report.Chunks, report.Bytes)
+			if report.Recent > 0 {
+				fmt.Printf("Kept %d unreachable entries younger than the grace period\n", report.Recent)
+			}
+		default:
+			Usage()
+			os.Exit(2)
 		}
 	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	diffContext = 3
+	// diffs needing more edits are shown as a full replacement
+	maxDiffEdits = 2000
+)
+
+type diffOp struct {
+	kind byte
+	line string
+}
+
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// isText tells whether data looks like text worth diffing
+func isText(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) < 0
+}
+
+// diffLines computes a shortest edit script from a to b (Myers)
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > 0 && max/2 > maxDiffEdits {
+		max = 2 * maxDiffEdits
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] holds v[-d-1..d+1] as it was at the start of round d
+	trace := make([][]int, 0)
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	if !found {
+		ops := make([]diffOp, 0, n+m)
+		for _, l := range a {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, diffOp{'+', l})
+		}
+		return ops
+	}
+
+	// backtrack from (n, m), collecting the script in reverse
+	rev := make([]diffOp, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		get := func(k int) int { return snap[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				rev = append(rev, diffOp{'+', b[y-1]})
+			} else {
+				rev = append(rev, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	ops := make([]diffOp, len(rev))
+	for i, op := range rev {
+		ops[len(rev)-1-i] = op
+	}
+	return ops
+}
+
+// unifiedDiff returns the unified diff turning a into b, empty if they are
+// equal
+func unifiedDiff(nameA, nameB string, a, b []byte) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	// line numbers in a and b before each op
+	aLine := make([]int, len(ops)+1)
+	bLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1] = aLine[i]
+		bLine[i+1] = bLine[i]
+		if op.kind != '+' {
+			aLine[i+1]++
+		}
+		if op.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	var buf bytes.Buffer
+	i := 0
+	for {
+		c := i
+		for c < len(ops) && ops[c].kind == ' ' {
+			c++
+		}
+		if c == len(ops) {
+			break
+		}
+
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+
+		start := c - diffContext
+		if start < i {
+			start = i
+		}
+		last := c
+		for j := c; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			} else if j-last > 2*diffContext {
+				break
+			}
+		}
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		aStart, aCount := aLine[start], aLine[end]-aLine[start]
+		bStart, bCount := bLine[start], bLine[end]-bLine[start]
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return buf.String()
+}
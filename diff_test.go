@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     string
+		b     string
+		edits int
+	}{
+		{"equal", "a\nb\nc\n", "a\nb\nc\n", 0},
+		{"both empty", "", "", 0},
+		{"from empty", "", "a\nb\n", 2},
+		{"to empty", "a\nb\n", "", 2},
+		{"insert", "a\nc\n", "a\nb\nc\n", 1},
+		{"delete", "a\nb\nc\n", "a\nc\n", 1},
+		{"replace", "a\nb\nc\n", "a\nx\nc\n", 2},
+		{"move", "a\nb\nc\nd\n", "b\nc\nd\na\n", 2},
+		{"disjoint", "a\nb\n", "c\nd\n", 4},
+		{"no newline", "a\nb", "a\nb\n", 2},
+	}
+	for _, test := range tests {
+		a, b := splitLines([]byte(test.a)), splitLines([]byte(test.b))
+		ops := diffLines(a, b)
+
+		var gotA, gotB strings.Builder
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA.WriteString(op.line)
+			}
+			if op.kind != '-' {
+				gotB.WriteString(op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if gotA.String() != test.a || gotB.String() != test.b {
+			t.Errorf("%s: script turns %q into %q, want %q into %q", test.name, gotA.String(), gotB.String(), test.a, test.b)
+		}
+		if edits != test.edits {
+			t.Errorf("%s: %d edits, want %d", test.name, edits, test.edits)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		diff string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"change", "a\nb\nc\n", "a\nx\nc\n", "--- a/f\n+++ b/f\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"new file", "", "a\n", "--- a/f\n+++ b/f\n@@ -0,0 +1,1 @@\n+a\n"},
+		{"no newline", "a", "b", "--- a/f\n+++ b/f\n@@ -1,1 +1,1 @@\n-a\n\\ No newline at end of file\n+b\n\\ No newline at end of file\n"},
+		{
+			"two hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"x\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ny\n",
+			"--- a/f\n+++ b/f\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n",
+		},
+	}
+	for _, test := range tests {
+		if diff := unifiedDiff("a/f", "b/f", []byte(test.a), []byte(test.b)); diff != test.diff {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, diff, test.diff)
+		}
+	}
+}
+
+func TestDiffLinesTooManyEdits(t *testing.T) {
+	a := make([]string, 0)
+	b := make([]string, 0)
+	for i := 0; i < 3*maxDiffEdits; i++ {
+		a = append(a, "a\n")
+		b = append(b, "b\n")
+	}
+	ops := diffLines(a, b)
+	if len(ops) != len(a)+len(b) {
+		t.Fatalf("%d ops, want a full replacement of %d", len(ops), len(a)+len(b))
+	}
+}
@@ -13,6 +13,11 @@ const (
 	CheckoutMismatch  = 4
 	UnknownFile       = 5
 	InvalidRequest    = 6
+	UnknownVersion    = 7
+	Locked            = 8
+	UnknownPath       = 9
+	ValidationFailed  = 10
+	PermissionDenied  = 11
 )
 
 func NewOperationError(t int, message string) *OperationError {
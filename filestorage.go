@@ -0,0 +1,687 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileBackend keeps every configuration file in its own directory under Root:
+//
+//	<Root>/<file>/HEAD          name of the current ref (cf. block=-1 in cassandra)
+//	<Root>/<file>/refs/<ref>    hash list of a version, one hash per line;
+//	                            refs are named by their unix time in ns
+//	<Root>/<file>/log/<ref>     commit info of a version (JSON)
+//	<Root>/<file>/lock          flock(2)ed while the ref or lease is changed
+//	<Root>/<file>/lease         edit lease (JSON)
+//	<Root>/<file>/pins/<host>   version the host is pinned to
+//	<Root>/chunks/<hash>        chunk data, shared by all files
+//	<Root>/<file>/chunks/<hash> chunk data kept per file by older versions
+//
+// All files are replaced through a rename within the same directory, so
+// readers on the same host or on a shared NFS mount never see partial writes.
+type FileBackend struct {
+	Root string
+}
+
+func NewFileBackend(root string) (*FileBackend, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileBackend{
+		Root: root,
+	}, nil
+}
+
+func (b *FileBackend) Open(file string, opts StorageOptions) (Storage, error) {
+	s := &FileStorage{
+		Root:      b.Root,
+		Dir:       filepath.Join(b.Root, url.PathEscape(file)),
+		File:      file,
+		Retention: opts.Retention,
+	}
+
+	if err := s.initStorage(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (b *FileBackend) Close() {
+}
+
+type FileStorage struct {
+	Root      string
+	Dir       string
+	File      string
+	Retention HistoryRetention
+}
+
+func (s *FileStorage) initStorage() error {
+	if err := os.MkdirAll(s.refPath(""), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.sharedChunkPath(""), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.logPath(""), 0755); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) headPath() string {
+	return filepath.Join(s.Dir, "HEAD")
+}
+
+func (s *FileStorage) refPath(ref string) string {
+	return filepath.Join(s.Dir, "refs", ref)
+}
+
+func (s *FileStorage) logPath(ref string) string {
+	return filepath.Join(s.Dir, "log", ref)
+}
+
+func (s *FileStorage) chunkPath(h string) string {
+	return filepath.Join(s.Dir, "chunks", h)
+}
+
+func (s *FileStorage) sharedChunkPath(h string) string {
+	return filepath.Join(s.Root, "chunks", h)
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames
+// it into place
+func writeFileAtomic(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+func (s *FileStorage) readHead() (string, error) {
+	b, err := ioutil.ReadFile(s.headPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *FileStorage) readRef(ref string) ([]string, error) {
+	b, err := ioutil.ReadFile(s.refPath(ref))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			res = append(res, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func (s *FileStorage) getHashes() ([]string, error) {
+	_, hashes, err := s.getHead()
+	return hashes, err
+}
+
+func (s *FileStorage) getHead() (string, []string, error) {
+	ref, err := s.readHead()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if ref == "" {
+		return "", make([]string, 0), nil
+	}
+
+	hashes, err := s.readRef(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	return ref, hashes, nil
+}
+
+func (s *FileStorage) getHeadVersion() (string, error) {
+	return s.readHead()
+}
+
+// lock serializes ref updates of all daemons sharing the directory
+func (s *FileStorage) lock() (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(s.Dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *FileStorage) unlock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+func (s *FileStorage) getVersionHashes(version string) ([]string, error) {
+	if _, err := strconv.ParseInt(version, 10, 64); err != nil {
+		return nil, NewOperationError(UnknownVersion, fmt.Sprintf("File %s: Version %s not found", s.File, version))
+	}
+
+	hashes, err := s.readRef(version)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NewOperationError(UnknownVersion, fmt.Sprintf("File %s: Version %s not found", s.File, version))
+		}
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func (s *FileStorage) listVersions() ([]Version, error) {
+	files, err := ioutil.ReadDir(s.refPath(""))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Version, 0)
+	for _, fi := range files {
+		ns, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil {
+			// temporary file
+			continue
+		}
+		v := Version{
+			Version: fi.Name(),
+			Time:    time.Unix(0, ns),
+		}
+		if b, err := ioutil.ReadFile(s.logPath(fi.Name())); err == nil {
+			if err := json.Unmarshal(b, &v.CommitInfo); err != nil {
+				log.Errorf("Cannot parse commit info of %s: %v", fi.Name(), err)
+			}
+		}
+		res = append(res, v)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time.After(res[j].Time)
+	})
+	return res, nil
+}
+
+func (s *FileStorage) setHashes(expected string, oldHashes, hashes []string, info CommitInfo, ph SetHashesProgressCallback) error {
+	l, err := s.lock()
+	if err != nil {
+		log.Errorf("Cannot lock %s: %v", s.Dir, err)
+		return err
+	}
+	defer s.unlock(l)
+
+	now := time.Now()
+	new_ref := strconv.FormatInt(now.UnixNano(), 10)
+
+	old_ref, err := s.readHead()
+	if err != nil {
+		log.Error("Error while trying to read the current ref", err)
+		return err
+	}
+	if old_ref != expected {
+		log.Errorf("Ref of file %s has been changed concurrently, expected %s", s.File, expected)
+		return NewOperationError(CheckoutMismatch, "The file has been changed by another commit")
+	}
+	info.Parent = old_ref
+
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.logPath(new_ref), infoBytes); err != nil {
+		log.Errorf("Error writing commit info of ref=%s: %v", new_ref, err)
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, h := range hashes {
+		buf.WriteString(h)
+		buf.WriteString("\n")
+	}
+
+	if err := writeFileAtomic(s.refPath(new_ref), buf.Bytes()); err != nil {
+		os.Remove(s.logPath(new_ref))
+		log.Errorf("Error writing ref=%s: %v", new_ref, err)
+		return err
+	}
+	ph()
+
+	if err := writeFileAtomic(s.headPath(), []byte(new_ref+"\n")); err != nil {
+		os.Remove(s.refPath(new_ref))
+		os.Remove(s.logPath(new_ref))
+		log.Errorf("Error updating the ref to %s for file %s: %v", new_ref, s.File, err)
+		return err
+	}
+
+	return s.pruneHistory(now, ph)
+}
+
+// pruneHistory drops the versions that are no longer retained along with the
+// chunks kept per file only they referenced; shared chunks are left to the
+// garbage collection
+func (s *FileStorage) pruneHistory(now time.Time, ph SetHashesProgressCallback) error {
+	versions, err := s.listVersions()
+	if err != nil {
+		log.Errorf("Cannot list history of %s: %v", s.File, err)
+		return err
+	}
+
+	pinned, err := s.pinnedVersions()
+	if err != nil {
+		log.Errorf("Cannot list pinned versions of %s: %v", s.File, err)
+		return err
+	}
+
+	expired := s.Retention.expired(versions, pinned, now)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	expiredSet := make(map[string]bool)
+	for _, v := range expired {
+		expiredSet[v.Version] = true
+	}
+
+	retainedHashes := make(map[string]bool)
+	for _, v := range versions {
+		if expiredSet[v.Version] {
+			continue
+		}
+		hashes, err := s.readRef(v.Version)
+		if err != nil {
+			log.Errorf("Cannot read version %s of %s: %v", v.Version, s.File, err)
+			return err
+		}
+		for _, h := range hashes {
+			retainedHashes[h] = true
+		}
+	}
+
+	for _, v := range expired {
+		hashes, err := s.readRef(v.Version)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Cannot read version %s of %s: %v", v.Version, s.File, err)
+			return err
+		}
+
+		os.Remove(s.refPath(v.Version))
+		os.Remove(s.logPath(v.Version))
+		ph()
+
+		// chunks kept per file by older versions
+		for _, h := range hashes {
+			if !retainedHashes[h] {
+				if err := os.Remove(s.chunkPath(h)); err == nil {
+					ph()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// CollectGarbage marks the hashes of the refs up to HEAD of every file and
+// sweeps the other refs and chunks. Refs newer than HEAD are left by commits
+// which failed before HEAD was updated; temporary files by interrupted
+// writes.
+func (b *FileBackend) CollectGarbage(grace time.Duration, dryRun bool) (*GCReport, error) {
+	limit := time.Now().Add(-grace)
+	report := &GCReport{Deleted: !dryRun}
+
+	// remove deletes an unreachable file older than the grace period and
+	// tells whether it was (or would be) deleted
+	remove := func(name string, fi os.FileInfo) bool {
+		if fi.ModTime().After(limit) {
+			report.Recent++
+			return false
+		}
+		if !dryRun {
+			if err := os.Remove(name); err != nil {
+				if !os.IsNotExist(err) {
+					log.Errorf("Cannot remove %s: %v", name, err)
+				}
+				return false
+			}
+		}
+		return true
+	}
+
+	dirs, err := ioutil.ReadDir(b.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	marked := make(map[string]bool)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		s := &FileStorage{Root: b.Root, Dir: filepath.Join(b.Root, d.Name()), File: d.Name()}
+		if _, err := os.Stat(s.refPath("")); err != nil {
+			// not a file directory
+			continue
+		}
+
+		fileMarked, err := s.collectGarbage(remove, report)
+		if err != nil {
+			return nil, err
+		}
+		for h := range fileMarked {
+			marked[h] = true
+		}
+	}
+
+	chunks, err := ioutil.ReadDir(filepath.Join(b.Root, "chunks"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range chunks {
+		// skip anything but chunks and temporary files
+		if marked[fi.Name()] || !fi.Mode().IsRegular() ||
+			(len(fi.Name()) != sha256.Size*2 && !strings.HasPrefix(fi.Name(), ".")) {
+			continue
+		}
+		name := filepath.Join(b.Root, "chunks", fi.Name())
+		// look again right before removing, the chunk may have been touched
+		if fi, err := os.Stat(name); err == nil && remove(name, fi) {
+			report.Chunks++
+			report.Bytes += fi.Size()
+		}
+	}
+
+	return report, nil
+}
+
+// collectGarbage sweeps the unreachable refs and the chunks kept for the
+// file, holding the lock so that no ref is written meanwhile; it returns
+// the hashes reachable from the file
+func (s *FileStorage) collectGarbage(remove func(string, os.FileInfo) bool, report *GCReport) (map[string]bool, error) {
+	l, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.unlock(l)
+
+	head, err := s.readHead()
+	if err != nil {
+		return nil, err
+	}
+	headNs, _ := strconv.ParseInt(head, 10, 64)
+
+	marked := make(map[string]bool)
+	live := make(map[string]bool)
+
+	files, err := ioutil.ReadDir(s.refPath(""))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		ns, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil || head == "" || ns > headNs {
+			// temporary file or ref of a failed commit
+			if remove(s.refPath(fi.Name()), fi) {
+				report.Refs++
+			}
+			continue
+		}
+
+		hashes, err := s.readRef(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		live[fi.Name()] = true
+		for _, h := range hashes {
+			marked[h] = true
+		}
+	}
+
+	files, err = ioutil.ReadDir(s.logPath(""))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !live[fi.Name()] {
+			// commit info of a ref removed or never written
+			remove(s.logPath(fi.Name()), fi)
+		}
+	}
+
+	files, err = ioutil.ReadDir(s.chunkPath(""))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range files {
+		if !marked[fi.Name()] && fi.Mode().IsRegular() && remove(s.chunkPath(fi.Name()), fi) {
+			report.Chunks++
+			report.Bytes += fi.Size()
+		}
+	}
+
+	return marked, nil
+}
+
+func (s *FileStorage) readChunk(h string) ([]byte, error) {
+	log.Debugf("FileStorage:readChunk(%s)", h)
+	var corrupt error
+	for _, p := range []string{s.sharedChunkPath(h), s.chunkPath(h)} {
+		data, err := ioutil.ReadFile(p)
+		if err == nil {
+			// a good copy kept per file may remain
+			if corrupt = verifyChunk(h, data); corrupt == nil {
+				return data, nil
+			}
+			log.Errorf("Chunk file %s is corrupt", p)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if corrupt != nil {
+		return nil, corrupt
+	}
+	return nil, fmt.Errorf("File %s: Chunk %s not found", s.File, h)
+}
+
+func (s *FileStorage) writeChunk(h string, data []byte) error {
+	log.Debugf("FileStorage:writeChunk(%s,%d)", h, len(data))
+	return writeFileAtomic(s.sharedChunkPath(h), data)
+}
+
+// touchChunk renews the modification time the garbage collection goes by
+func (s *FileStorage) touchChunk(h string) (bool, error) {
+	now := time.Now()
+	if err := os.Chtimes(s.sharedChunkPath(h), now, now); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileStorage) leasePath() string {
+	return filepath.Join(s.Dir, "lease")
+}
+
+func (s *FileStorage) readLease() (*Lease, error) {
+	b, err := ioutil.ReadFile(s.leasePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var l Lease
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+
+	if l.Expires.Before(time.Now()) {
+		return nil, nil
+	}
+	return &l, nil
+}
+
+func (s *FileStorage) getLease() (*Lease, error) {
+	return s.readLease()
+}
+
+func (s *FileStorage) acquireLease(l Lease, ttl time.Duration) error {
+	lf, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock(lf)
+
+	current, err := s.readLease()
+	if err != nil {
+		return err
+	}
+	if current != nil && current.Host != l.Host {
+		return lockedError(current)
+	}
+
+	l.File = s.File
+	l.Expires = time.Now().Add(ttl)
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.leasePath(), b)
+}
+
+func (s *FileStorage) releaseLease(host string, force bool) error {
+	lf, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock(lf)
+
+	if !force {
+		current, err := s.readLease()
+		if err != nil {
+			return err
+		}
+		if current != nil && current.Host != host {
+			return lockedError(current)
+		}
+	}
+
+	if err := os.Remove(s.leasePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) pinPath(host string) string {
+	return filepath.Join(s.Dir, "pins", host)
+}
+
+// setPin is locked against pruneHistory, which runs with the ref lock held
+func (s *FileStorage) setPin(host string, version string) error {
+	lf, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock(lf)
+
+	if version == "" {
+		if err := os.Remove(s.pinPath(host)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(s.pinPath(""), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.pinPath(host), []byte(version+"\n"))
+}
+
+func (s *FileStorage) pinnedVersions() (map[string]bool, error) {
+	res := make(map[string]bool)
+	files, err := ioutil.ReadDir(s.pinPath(""))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return res, nil
+		}
+		return nil, err
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			// temporary file
+			continue
+		}
+		b, err := ioutil.ReadFile(s.pinPath(fi.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if version := strings.TrimSpace(string(b)); version != "" {
+			res[version] = true
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFileStorage opens the storage of file on a file backend in dir
+func openFileStorage(t *testing.T, dir string, file string) *FileStorage {
+	backend, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := backend.Open(file, StorageOptions{Retention: HistoryRetention{Keep: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*FileStorage)
+}
+
+func TestFileStorageSetHashes(t *testing.T) {
+	s := openFileStorage(t, t.TempDir(), "/a.tgz")
+
+	if err := s.setHashes("", nil, []string{"h1", "h2"}, CommitInfo{Message: "one"}, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	v1, hashes, err := s.getHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1 == "" || !reflect.DeepEqual(hashes, []string{"h1", "h2"}) {
+		t.Fatalf("head %s %v after the first commit", v1, hashes)
+	}
+
+	// the head names the ref swapped in, the ref holds one hash per line
+	head, err := ioutil.ReadFile(s.headPath())
+	if err != nil || string(head) != v1+"\n" {
+		t.Errorf("HEAD holds %q, %v", head, err)
+	}
+	ref, err := ioutil.ReadFile(s.refPath(v1))
+	if err != nil || string(ref) != "h1\nh2\n" {
+		t.Errorf("ref holds %q, %v", ref, err)
+	}
+
+	if err := s.setHashes(v1, hashes, []string{"h3"}, CommitInfo{Message: "two"}, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	v2, hashes, err := s.getHead()
+	if err != nil || v2 == v1 || !reflect.DeepEqual(hashes, []string{"h3"}) {
+		t.Fatalf("head %s %v, %v after the second commit", v2, hashes, err)
+	}
+
+	// a commit based on v1 lost the race
+	err = s.setHashes(v1, nil, []string{"h4"}, CommitInfo{Message: "stale"}, func() {})
+	if GetErrorType(err) != CheckoutMismatch {
+		t.Fatalf("stale commit: %v", err)
+	}
+	if head, _, _ := s.getHead(); head != v2 {
+		t.Errorf("head %s after a stale commit, want %s", head, v2)
+	}
+
+	versions, err := s.listVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != v2 || versions[0].Parent != v1 || versions[0].Message != "two" {
+		t.Errorf("history %+v", versions)
+	}
+
+	// nothing is left behind by the renames
+	for _, dir := range []string{s.Dir, s.refPath(""), s.logPath("")} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range files {
+			if strings.HasPrefix(fi.Name(), ".") {
+				t.Errorf("temporary file %s left in %s", fi.Name(), dir)
+			}
+		}
+	}
+}
+
+func TestFileStorageConcurrentCommits(t *testing.T) {
+	dir := t.TempDir()
+	const committers = 8
+	const commits = 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, committers)
+	for i := 0; i < committers; i++ {
+		// every committer has its own storage, as daemons sharing the
+		// directory have
+		s := openFileStorage(t, dir, "/a.tgz")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < commits; {
+				head, err := s.getHeadVersion()
+				if err != nil {
+					errs <- err
+					return
+				}
+				err = s.setHashes(head, nil, []string{head}, CommitInfo{}, func() {})
+				if GetErrorType(err) == CheckoutMismatch {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				done++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// every commit saw the one before it
+	s := openFileStorage(t, dir, "/a.tgz")
+	versions, err := s.listVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != committers*commits {
+		t.Fatalf("%d versions, want %d", len(versions), committers*commits)
+	}
+	for i, v := range versions {
+		parent := ""
+		if i+1 < len(versions) {
+			parent = versions[i+1].Version
+		}
+		hashes, err := s.getVersionHashes(v.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Parent != parent || (parent != "" && !reflect.DeepEqual(hashes, []string{parent})) {
+			t.Errorf("version %s has parent %s and hashes %v, want %s", v.Version, v.Parent, hashes, parent)
+		}
+	}
+}
+
+func TestFileStorageLease(t *testing.T) {
+	dir := t.TempDir()
+	a := openFileStorage(t, dir, "/a.tgz")
+	b := openFileStorage(t, dir, "/a.tgz")
+
+	if err := a.acquireLease(Lease{Host: "a", User: "alice"}, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := b.getLease(); err != nil || l == nil || l.Host != "a" || l.File != "/a.tgz" {
+		t.Fatalf("lease %+v, %v", l, err)
+	}
+	if err := b.acquireLease(Lease{Host: "b"}, time.Minute); GetErrorType(err) != Locked {
+		t.Errorf("acquiring a held lease: %v", err)
+	}
+	if err := b.releaseLease("b", false); GetErrorType(err) != Locked {
+		t.Errorf("releasing the lease of another host: %v", err)
+	}
+	// the holder renews its lease
+	if err := a.acquireLease(Lease{Host: "a"}, 200*time.Millisecond); err != nil {
+		t.Errorf("renewing the lease: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if l, err := b.getLease(); err != nil || l != nil {
+		t.Fatalf("expired lease %+v, %v", l, err)
+	}
+	if err := b.acquireLease(Lease{Host: "b"}, time.Minute); err != nil {
+		t.Fatalf("acquiring an expired lease: %v", err)
+	}
+
+	// unlock -f breaks the lease of another host
+	if err := a.releaseLease("a", true); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := b.getLease(); err != nil || l != nil {
+		t.Errorf("lease %+v, %v after breaking it", l, err)
+	}
+}
+
+func TestFileBackendCollectGarbage(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewFileBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := openFileStorage(t, dir, "/a.tgz")
+
+	hash := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hashToStr(sum[:])
+	}
+	live, orphan := hash("live"), hash("orphan")
+	for _, data := range []string{"live", "orphan"} {
+		if err := s.writeChunk(hash(data), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.setHashes("", nil, []string{live}, CommitInfo{}, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	head, err := s.readHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := strconv.ParseInt(head, 10, 64)
+	// the ref of a commit in progress or failed
+	pending := s.refPath(strconv.FormatInt(ns+1, 10))
+	if err := ioutil.WriteFile(pending, []byte(orphan+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	report, err := backend.CollectGarbage(time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Recent != 2 || report.Refs != 0 || report.Chunks != 0 {
+		t.Errorf("recent entries collected: %+v", report)
+	}
+	if !exists(s.sharedChunkPath(orphan)) || !exists(pending) {
+		t.Errorf("recent entries removed")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, p := range []string{s.sharedChunkPath(live), s.sharedChunkPath(orphan), pending} {
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = backend.CollectGarbage(time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Refs != 1 || report.Chunks != 1 || report.Deleted || !exists(pending) {
+		t.Errorf("dry run: %+v", report)
+	}
+
+	report, err = backend.CollectGarbage(time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Recent != 0 || report.Refs != 1 || report.Chunks != 1 || report.Bytes != int64(len("orphan")) {
+		t.Errorf("old entries not collected: %+v", report)
+	}
+	if exists(s.sharedChunkPath(orphan)) || exists(pending) {
+		t.Errorf("old unreachable entries kept")
+	}
+	if !exists(s.sharedChunkPath(live)) {
+		t.Errorf("reachable chunk removed")
+	}
+}
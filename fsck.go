@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FsckReport lists the problems found checking the stored and cached
+// chunks of a file and whether its archives read back. Problems which have
+// been repaired are only listed in Repaired.
+type FsckReport struct {
+	File     string   `json:"file"`
+	Versions int      `json:"versions"`
+	Chunks   int      `json:"chunks"`
+	Cached   int      `json:"cached"`
+	Missing  []string `json:"missing,omitempty"`
+	Corrupt  []string `json:"corrupt,omitempty"`
+	// CacheCorrupt lists the cached chunks not matching their hash
+	CacheCorrupt []string `json:"cache_corrupt,omitempty"`
+	// Broken lists the versions whose archive cannot be read, with the error
+	Broken   []string `json:"broken,omitempty"`
+	Repaired []string `json:"repaired,omitempty"`
+}
+
+func (r *FsckReport) Clean() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0 && len(r.CacheCorrupt) == 0 && len(r.Broken) == 0
+}
+
+// Fsck checks every chunk of the retained versions in the storage and in
+// the cache and reads every archive back. With repair set bad stored chunks
+// are restored from good cached copies and vice versa.
+func (sys *System) Fsck(repair bool) (*FsckReport, error) {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	s := sys.s
+	c := sys.c
+
+	versions, err := s.listVersions()
+	if err != nil {
+		log.Errorf("Cannot list history: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	versionHashes := make(map[string][]string)
+	order := make([]string, 0)
+	for _, v := range versions {
+		hashes, err := s.getVersionHashes(v.Version)
+		if err != nil {
+			if GetErrorType(err) == UnknownVersion {
+				continue
+			}
+			log.Errorf("Cannot get hash list from DB: %s", err.Error())
+			return nil, NewOperationError(InternalError, err.Error())
+		}
+		versionHashes[v.Version] = hashes
+		order = append(order, v.Version)
+	}
+	if len(order) == 0 {
+		// files written before history was kept
+		hashes, err := s.getHashes()
+		if err != nil {
+			log.Errorf("Cannot get hash list from DB: %s", err.Error())
+			return nil, NewOperationError(InternalError, err.Error())
+		}
+		if len(hashes) > 0 {
+			versionHashes[""] = hashes
+			order = append(order, "")
+		}
+	}
+
+	report := &FsckReport{
+		Versions: len(order),
+	}
+
+	bad := make(map[string]bool)
+	checked := make(map[string]bool)
+	for _, v := range order {
+		for _, h := range versionHashes[v] {
+			if checked[h] {
+				continue
+			}
+			checked[h] = true
+			report.Chunks++
+
+			_, err := s.readChunk(h)
+			if err == nil {
+				continue
+			}
+
+			if repair {
+				if r, cerr := c.openChunk(h); cerr == nil {
+					data, _ := ioutil.ReadAll(r)
+					r.Close()
+					if werr := s.writeChunk(h, data); werr == nil {
+						report.Repaired = append(report.Repaired, h)
+						continue
+					}
+				}
+			}
+
+			bad[h] = true
+			if isCorruptChunk(err) {
+				report.Corrupt = append(report.Corrupt, h)
+			} else {
+				log.Errorf("Cannot read chunk %s: %s", h, err.Error())
+				report.Missing = append(report.Missing, h)
+			}
+		}
+	}
+
+	cached, err := c.getCachedHashes()
+	if err != nil {
+		log.Errorf("Cannot get cached hash list: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+	for _, h := range cached {
+		r, err := c.openChunk(h)
+		if err == nil {
+			r.Close()
+			report.Cached++
+			continue
+		} else if os.IsNotExist(err) {
+			continue
+		}
+		report.Cached++
+
+		if repair && !bad[h] {
+			if data, err := s.readChunk(h); err == nil {
+				if err := c.writeChunk(h, data); err == nil {
+					report.Repaired = append(report.Repaired, h)
+					continue
+				}
+			}
+		}
+		report.CacheCorrupt = append(report.CacheCorrupt, h)
+	}
+
+	open := storedChunkOpener(s)
+	for _, v := range order {
+		hashes := versionHashes[v]
+		skip := false
+		for _, h := range hashes {
+			skip = skip || bad[h]
+		}
+		if skip {
+			// already reported
+			continue
+		}
+
+		if err := walkArchive(hashes, open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		}); err != nil {
+			report.Broken = append(report.Broken, v+": "+err.Error())
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(sys *System, h string) string
+		report  func(r *FsckReport) []string
+	}{
+		{"cached", func(sys *System, h string) string {
+			return filepath.Join(sys.c.CacheDir, h)
+		}, func(r *FsckReport) []string { return r.CacheCorrupt }},
+		{"stored", func(sys *System, h string) string {
+			return sys.s.(*FileStorage).sharedChunkPath(h)
+		}, func(r *FsckReport) []string { return r.Corrupt }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sys := newTestSystem(t)
+			commitFiles(t, sys, map[string]string{"a": "1", "b": "2"})
+			// fills the cache
+			if err := sys.Update(true, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := sys.Fsck(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Clean() || report.Versions != 1 || report.Chunks == 0 || report.Cached != report.Chunks {
+				t.Fatalf("fresh commit: %+v", report)
+			}
+
+			hashes, err := sys.s.getHashes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := hashes[0]
+			if err := ioutil.WriteFile(test.corrupt(sys, h), []byte("corrupt"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err = sys.Fsck(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Clean() || !reflect.DeepEqual(test.report(report), []string{h}) || len(report.Repaired) != 0 {
+				t.Errorf("corrupt chunk: %+v", report)
+			}
+
+			report, err = sys.Fsck(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Clean() || !reflect.DeepEqual(report.Repaired, []string{h}) {
+				t.Errorf("repair: %+v", report)
+			}
+
+			report, err = sys.Fsck(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Clean() || len(report.Repaired) != 0 {
+				t.Errorf("after repair: %+v", report)
+			}
+		})
+	}
+}
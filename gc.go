@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// GCReport describes the refs and chunks a garbage collection found
+// unreachable from the current ref and the retained history of every file
+type GCReport struct {
+	Refs   int   `json:"refs"`
+	Chunks int   `json:"chunks"`
+	Bytes  int64 `json:"bytes"`
+	// Recent counts unreachable entries younger than the grace period;
+	// they may belong to a commit in progress and are kept
+	Recent  int  `json:"recent"`
+	Deleted bool `json:"deleted"`
+}
+
+// Collector runs the garbage collection of a storage backend, on request
+// or periodically
+type Collector struct {
+	backend StorageBackend
+	grace   time.Duration
+	lock    *sync.Mutex
+}
+
+func NewCollector(backend StorageBackend, grace time.Duration) *Collector {
+	return &Collector{
+		backend: backend,
+		grace:   grace,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Run collects garbage; with dryRun set nothing is deleted
+func (gc *Collector) Run(dryRun bool) (*GCReport, error) {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+
+	report, err := gc.backend.CollectGarbage(gc.grace, dryRun)
+	if err != nil {
+		log.Errorf("Garbage collection failed: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	log.Infof("Garbage collection: %d refs, %d chunks (%d bytes) unreachable, %d recent, deleted=%v",
+		report.Refs, report.Chunks, report.Bytes, report.Recent, report.Deleted)
+	return report, nil
+}
+
+// schedule runs the collection every interval
+func (gc *Collector) schedule(interval time.Duration) {
+	time.AfterFunc(interval, func() {
+		gc.Run(false)
+		gc.schedule(interval)
+	})
+}
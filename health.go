@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// maxBadVersions limits the number of versions remembered as bad
+const maxBadVersions = 10
+
+// HealthStatus reports the health checks run after updates of a file
+type HealthStatus struct {
+	Checks   int64 `json:"checks"`
+	Failures int64 `json:"failures"`
+	Restores int64 `json:"restores"`
+	// Bad lists the content hashes of the versions which failed the check
+	// on this node; the update loop does not apply them again
+	Bad []string `json:"bad,omitempty"`
+}
+
+// restored counts a previous version restored after a failed check
+func (h *Hooks) restored() {
+	h.lock.Lock()
+	h.health.Restores++
+	h.lock.Unlock()
+}
+
+// Health returns the health check counters and the versions marked bad
+func (sys *System) Health() *HealthStatus {
+	sys.hooks.lock.Lock()
+	health := sys.hooks.health
+	sys.hooks.lock.Unlock()
+
+	health.Bad = badVersions(sys.c)
+	return &health
+}
+
+// badVersions returns the versions marked bad, kept in the cache meta data
+// of the owner
+func badVersions(c *Cache) []string {
+	res := make([]string, 0)
+
+	r, err := c.openMeta("bad")
+	if err != nil {
+		return res
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+func isBad(c *Cache, hash string) bool {
+	for _, h := range badVersions(c) {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func writeBadVersions(c *Cache, hashes []string) error {
+	if len(hashes) == 0 {
+		return c.removeMeta("bad")
+	}
+	var buf bytes.Buffer
+	for _, h := range hashes {
+		buf.WriteString(h)
+		buf.WriteString("\n")
+	}
+	return c.writeMeta("bad", buf.Bytes())
+}
+
+func markBad(c *Cache, hash string) error {
+	if isBad(c, hash) {
+		return nil
+	}
+	bad := append(badVersions(c), hash)
+	if len(bad) > maxBadVersions {
+		bad = bad[len(bad)-maxBadVersions:]
+	}
+	return writeBadVersions(c, bad)
+}
+
+// clearBad forgets a bad version once it has been applied on request
+func clearBad(c *Cache, hash string) error {
+	bad := badVersions(c)
+	res := make([]string, 0, len(bad))
+	for _, h := range bad {
+		if h != hash {
+			res = append(res, h)
+		}
+	}
+	if len(res) == len(bad) {
+		return nil
+	}
+	return writeBadVersions(c, res)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHealthCheckRestore(t *testing.T) {
+	sys := newTestSystem(t)
+	sys.hooks = NewHooks(sys.c.Owner, sys.w.Root, HookOptions{
+		HealthCheck: `! grep -q bad "$DCD_WORKSPACE/a"`,
+	})
+	commitFiles(t, sys, map[string]string{"a": "good"})
+	if err := sys.poll(); err != nil {
+		t.Fatal(err)
+	}
+	checks := sys.Health().Checks
+
+	// another node commits a version failing the check on this one
+	c := &Cache{CacheDir: t.TempDir(), ChunkSize: 65536, Owner: "/test.tgz"}
+	if err := c.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	other := NewSystem(sys.s, c, &Workspace{Root: filepath.Join(t.TempDir(), "ws")}, SystemOptions{})
+	commitFiles(t, other, map[string]string{"a": "bad"})
+	hashes, err := sys.s.getHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, _ := contentHash(hashes)
+
+	if err := sys.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if files := readFiles(t, sys); files["a"] != "good" {
+		t.Errorf("workspace holds %v after the failed check", files)
+	}
+	health := sys.Health()
+	if health.Checks != checks+1 || health.Failures != 1 || health.Restores != 1 || len(health.Bad) != 1 || health.Bad[0] != bad {
+		t.Errorf("health after the failed check: %+v", health)
+	}
+
+	// the bad version is not applied again
+	sys.polled = ""
+	if err := sys.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if files := readFiles(t, sys); files["a"] != "good" {
+		t.Errorf("workspace holds %v after polling again", files)
+	}
+	if health := sys.Health(); health.Checks != checks+1 {
+		t.Errorf("bad version checked again: %+v", health)
+	}
+
+	// unless applied on request
+	if err := sys.Update(false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if files := readFiles(t, sys); files["a"] != "bad" {
+		t.Errorf("workspace holds %v after update", files)
+	}
+	if health := sys.Health(); len(health.Bad) != 0 {
+		t.Errorf("bad version kept after update: %+v", health)
+	}
+}
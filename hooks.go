@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	PreUpdateHook  = "pre-update"
+	PostUpdateHook = "post-update"
+	PostCommitHook = "post-commit"
+	// HealthCheckHook runs after an update by the update loop; if it fails
+	// the previous version is restored
+	HealthCheckHook = "health-check"
+)
+
+// maxHookOutput limits the output kept of a hook run
+const maxHookOutput = 64 * 1024
+
+// HookOptions are the commands run when the workspace of a file changes.
+// A failing pre-update hook cancels the update. Commands are run by sh with
+// DCD_HOOK, DCD_FILE, DCD_WORKSPACE, DCD_OLD_HASH, DCD_NEW_HASH and
+// DCD_CHANGED (the changed paths, one per line) set.
+type HookOptions struct {
+	PreUpdate  string
+	PostUpdate string
+	PostCommit string
+	// HealthCheck is run after updates of the update loop, see
+	// HealthCheckHook
+	HealthCheck string
+	// Timeout after which a hook is killed, 0 for none
+	Timeout time.Duration
+}
+
+// HookResult describes the last run of a hook
+type HookResult struct {
+	Hook     string        `json:"hook"`
+	Command  string        `json:"command"`
+	OldHash  string        `json:"old_hash,omitempty"`
+	NewHash  string        `json:"new_hash"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	ExitCode int           `json:"exit_code"`
+	Output   string        `json:"output,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type Hooks struct {
+	opts    HookOptions
+	file    string
+	root    string
+	lock    *sync.Mutex
+	results map[string]*HookResult
+	health  HealthStatus
+	// watchers receive an event for every version applied
+	watchers *watchers
+}
+
+func NewHooks(file string, root string, opts HookOptions) *Hooks {
+	return &Hooks{
+		opts:    opts,
+		file:    file,
+		root:    root,
+		lock:    &sync.Mutex{},
+		results: make(map[string]*HookResult),
+
+		watchers: newWatchers(),
+	}
+}
+
+func (h *Hooks) command(hook string) string {
+	if h == nil {
+		return ""
+	}
+	switch hook {
+	case PreUpdateHook:
+		return h.opts.PreUpdate
+	case PostUpdateHook:
+		return h.opts.PostUpdate
+	case PostCommitHook:
+		return h.opts.PostCommit
+	case HealthCheckHook:
+		return h.opts.HealthCheck
+	}
+	return ""
+}
+
+// configured tells whether any of the hooks has a command
+func (h *Hooks) configured(hooks ...string) bool {
+	for _, hook := range hooks {
+		if h.command(hook) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs a hook; it fails unless the command exits with status 0 before
+// the timeout
+func (h *Hooks) run(hook string, oldHash string, newHash string, changed []string) error {
+	command := h.command(hook)
+	if command == "" {
+		return nil
+	}
+
+	res := &HookResult{
+		Hook:    hook,
+		Command: command,
+		OldHash: oldHash,
+		NewHash: newHash,
+		Started: time.Now(),
+	}
+
+	output, exitCode, err := runCommand(command, []string{
+		"DCD_HOOK=" + hook,
+		"DCD_FILE=" + h.file,
+		"DCD_WORKSPACE=" + h.root,
+		"DCD_OLD_HASH=" + oldHash,
+		"DCD_NEW_HASH=" + newHash,
+		"DCD_CHANGED=" + strings.Join(changed, "\n"),
+	}, h.opts.Timeout)
+
+	res.Duration = time.Since(res.Started)
+	res.Output = output
+	res.ExitCode = exitCode
+	if err != nil {
+		res.Error = err.Error()
+		log.Errorf("Hook %s of %s failed: %s\n%s", hook, h.file, err.Error(), res.Output)
+	} else {
+		log.Infof("Hook %s of %s done in %s\n%s", hook, h.file, res.Duration, res.Output)
+	}
+
+	h.lock.Lock()
+	h.results[hook] = res
+	if hook == HealthCheckHook {
+		h.health.Checks++
+		if err != nil {
+			h.health.Failures++
+		}
+	}
+	h.lock.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("Hook %s failed: %s", hook, err.Error())
+	}
+	return nil
+}
+
+// runCommand runs command by sh with env added to the environment and
+// returns its output and exit code; it fails unless the command exits with
+// status 0 before the timeout
+func runCommand(command string, env []string, timeout time.Duration) (string, int, error) {
+	var out limitedBuffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// a process group of its own, so that a timeout kills what the command started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case err = <-done:
+		case <-expired:
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+			err = fmt.Errorf("Timed out after %s", timeout)
+		}
+	}
+
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return out.String(), exitCode, err
+}
+
+// Results returns the last run of every hook which has run
+func (h *Hooks) Results() []*HookResult {
+	res := make([]*HookResult, 0)
+	if h == nil {
+		return res
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, hook := range []string{PreUpdateHook, PostUpdateHook, HealthCheckHook, PostCommitHook} {
+		if r, ok := h.results[hook]; ok {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Hooks returns the last run of every hook
+func (sys *System) Hooks() []*HookResult {
+	return sys.hooks.Results()
+}
+
+// limitedBuffer keeps the first maxHookOutput bytes written to it
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := maxHookOutput - b.buf.Len(); len(p) > n {
+		b.buf.Write(p[:n])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+// changedPaths lists the entries added, removed or changed between two
+// archives
+func changedPaths(oldHashes []string, newHashes []string, open ChunkOpener) ([]string, error) {
+	oldManifest, err := readManifest(oldHashes, open)
+	if err != nil {
+		return nil, err
+	}
+	newManifest, err := readManifest(newHashes, open)
+	if err != nil {
+		return nil, err
+	}
+	// the chunk lists of format 3 archives stand in for the content,
+	// other archives are compared by content
+	byChunks := oldManifest != nil && newManifest != nil
+
+	oldEntries, err := archiveDigests(oldHashes, oldManifest, byChunks, open)
+	if err != nil {
+		return nil, err
+	}
+	newEntries, err := archiveDigests(newHashes, newManifest, byChunks, open)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0)
+	for p, d := range newEntries {
+		if old, ok := oldEntries[p]; !ok || old != d {
+			res = append(res, p)
+		}
+	}
+	for p := range oldEntries {
+		if _, ok := newEntries[p]; !ok {
+			res = append(res, p)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// archiveDigests maps the entries of an archive to their mode and content
+func archiveDigests(hashes []string, m *Manifest, byChunks bool, open ChunkOpener) (map[string]string, error) {
+	res := make(map[string]string)
+	if len(hashes) == 0 {
+		return res, nil
+	}
+
+	if byChunks {
+		for _, e := range m.Entries {
+			res[e.Path] = fmt.Sprintf("%s %s", e.Mode, strings.Join(e.Chunks, ","))
+		}
+		return res, nil
+	}
+
+	err := walkArchive(hashes, open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		sum, _, err := hashReader(r, false)
+		if err != nil {
+			return err
+		}
+		res[header.Name] = fmt.Sprintf("%s %s", mode, sum)
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		env     []string
+		output  string
+		code    int
+		ok      bool
+	}{
+		{"echo $DCD_TEST", []string{"DCD_TEST=hello"}, "hello\n", 0, true},
+		{"echo out; echo err >&2; exit 3", nil, "out\nerr\n", 3, false},
+	}
+	for _, test := range tests {
+		output, code, err := runCommand(test.command, test.env, time.Minute)
+		if output != test.output || code != test.code || (err == nil) != test.ok {
+			t.Errorf("%s: %q, %d, %v", test.command, output, code, err)
+		}
+	}
+}
+
+// alive tells whether process pid runs; a zombie waiting to be reaped does
+// not
+func alive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	start := time.Now()
+	// the background child holds the output open and is only stopped by
+	// killing the process group
+	_, _, err := runCommand("sleep 30 & echo $! > "+pidFile+"; wait", nil, 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("timeout not reported: %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("returned after %s", d)
+	}
+
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && alive(pid); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if alive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("child %d of the hook survived the timeout", pid)
+	}
+}
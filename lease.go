@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func lockedError(l *Lease) error {
+	return NewOperationError(Locked, fmt.Sprintf("The file is being edited by %s@%s (lease expires %s)",
+		l.User, l.Host, l.Expires.Local().Format("2006-01-02 15:04:05")))
+}
+
+// acquireLease takes the cluster-wide edit lease for this host if leases
+// are enabled
+func (sys *System) acquireLease(user string) error {
+	if sys.opts.LeaseTTL <= 0 {
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	if err := sys.s.acquireLease(Lease{
+		Host: hostname,
+		User: user,
+	}, sys.opts.LeaseTTL); err != nil {
+		if GetErrorType(err) == Locked {
+			return err
+		}
+		log.Errorf("Cannot acquire lease: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	return nil
+}
+
+// checkLease fails if another host holds the edit lease
+func (sys *System) checkLease() error {
+	if sys.opts.LeaseTTL <= 0 {
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	l, err := sys.s.getLease()
+	if err != nil {
+		log.Errorf("Cannot get lease: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	if l != nil && l.Host != hostname {
+		return lockedError(l)
+	}
+
+	return nil
+}
+
+// renewLease extends the lease held by this host while the workspace is
+// checked out
+func (sys *System) renewLease() {
+	if sys.opts.LeaseTTL <= 0 {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+
+	l, err := sys.s.getLease()
+	if err != nil || l == nil || l.Host != hostname {
+		return
+	}
+
+	if err := sys.s.acquireLease(*l, sys.opts.LeaseTTL); err != nil {
+		log.Errorf("Cannot renew lease: %s", err.Error())
+	}
+}
+
+// releaseLease drops the lease held by this host
+func (sys *System) releaseLease() {
+	if sys.opts.LeaseTTL <= 0 {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return
+	}
+
+	if err := sys.s.releaseLease(hostname, false); err != nil && GetErrorType(err) != Locked {
+		log.Errorf("Cannot release lease: %s", err.Error())
+	}
+}
+
+func (sys *System) Locks() ([]Lease, error) {
+	l, err := sys.s.getLease()
+	if err != nil {
+		log.Errorf("Cannot get lease: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	res := make([]Lease, 0)
+	if l != nil {
+		res = append(res, *l)
+	}
+	return res, nil
+}
+
+// Unlock releases the lease of this host; force breaks a lease held by
+// any host
+func (sys *System) Unlock(force bool) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	if err := sys.s.releaseLease(hostname, force); err != nil {
+		if GetErrorType(err) == Locked {
+			return NewOperationError(Locked, err.Error()+". Use -f to break it")
+		}
+		log.Errorf("Cannot release lease: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// manifestMagic starts the manifest chunk of a format 3 archive. Older
+// archives are a gzip compressed tar stream and start with the gzip magic.
+var manifestMagic = []byte("dcd-manifest-3\n")
+
+// A format 3 archive is stored as a manifest chunk followed by the content
+// chunks of its entries; the manifest lists the entries in archive order
+// and the chunks holding the content of each one
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+type ManifestEntry struct {
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+func encodeManifest(m *Manifest) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(manifestMagic)
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(m); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeManifest parses a manifest chunk whose magic has been consumed
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.NewDecoder(gz).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// readManifest returns the manifest of a format 3 archive or nil if the
+// archive has an older format
+func readManifest(hashes []string, open ChunkOpener) (*Manifest, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	r, err := open(hashes[0])
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	magic := make([]byte, len(manifestMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, manifestMagic) {
+		return nil, nil
+	}
+
+	return decodeManifest(r)
+}
+
+// walk calls f for every entry of the manifest; the content chunks of an
+// entry are only read if f reads from r
+func (m *Manifest) walk(open ChunkOpener, f ArchiveWalkFunc) error {
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		r := e.open(open)
+		err := f(e.header(), e.Mode, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeArchive writes the manifest as a gzip compressed tar stream
+func (m *Manifest) writeArchive(open ChunkOpener, w io.Writer, progress func()) error {
+	gzStream := gzip.NewWriter(w)
+	tarStream := tar.NewWriter(gzStream)
+
+	if err := m.walk(open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		if err := tarStream.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarStream, r); err != nil {
+			return err
+		}
+		progress()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := tarStream.Close(); err != nil {
+		return err
+	}
+	return gzStream.Close()
+}
+
+func (e *ManifestEntry) header() *tar.Header {
+	header := &tar.Header{
+		Name:    e.Path,
+		Mode:    int64(e.Mode &^ os.ModeDir),
+		ModTime: e.ModTime,
+	}
+	if e.Mode.IsDir() {
+		header.Typeflag = tar.TypeDir
+	} else {
+		header.Typeflag = tar.TypeReg
+		header.Size = e.Size
+	}
+	return header
+}
+
+// sameContent tells whether e has the same mode and content as o
+func (e *ManifestEntry) sameContent(o *ManifestEntry) bool {
+	if o == nil || e.Mode != o.Mode || e.Size != o.Size || len(e.Chunks) != len(o.Chunks) {
+		return false
+	}
+	for i := range e.Chunks {
+		if e.Chunks[i] != o.Chunks[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// open returns the content of the entry; every chunk is compressed on its
+// own, together they read as one multi-member gzip stream
+func (e *ManifestEntry) open(open ChunkOpener) io.ReadCloser {
+	return &entryReader{chunks: newChunkReader(e.Chunks, open), empty: len(e.Chunks) == 0}
+}
+
+type entryReader struct {
+	chunks *chunkReader
+	gz     *gzip.Reader
+	empty  bool
+}
+
+func (r *entryReader) Read(p []byte) (int, error) {
+	if r.empty {
+		return 0, io.EOF
+	}
+	if r.gz == nil {
+		gz, err := gzip.NewReader(r.chunks)
+		if err != nil {
+			return 0, err
+		}
+		r.gz = gz
+	}
+	return r.gz.Read(p)
+}
+
+func (r *entryReader) Close() error {
+	return r.chunks.Close()
+}
+
+// manifestWriter stores the entries passed to add as a format 3 archive
+type manifestWriter struct {
+	s         ChunkStore
+	chunkSize int64
+	known     map[string]bool
+	listed    map[string]bool
+	hashes    []string
+	m         Manifest
+	progress  func()
+}
+
+// newManifestWriter returns a writer storing chunks to s; chunks listed in
+// known are already stored and are not written again
+func newManifestWriter(s ChunkStore, chunkSize int64, known []string, progress func()) *manifestWriter {
+	mw := &manifestWriter{
+		s:         s,
+		chunkSize: chunkSize,
+		known:     make(map[string]bool),
+		listed:    make(map[string]bool),
+		hashes:    make([]string, 0),
+		m:         Manifest{Entries: make([]ManifestEntry, 0)},
+		progress:  progress,
+	}
+	for _, h := range known {
+		mw.known[h] = true
+	}
+	return mw
+}
+
+func (mw *manifestWriter) writeChunk(chunk []byte) (string, error) {
+	hash := sha256.Sum256(chunk)
+	h := hashToStr(hash[:])
+	if !mw.known[h] {
+		// the chunk may be stored for another file or version already
+		exists, err := mw.s.touchChunk(h)
+		if err != nil {
+			log.Errorf("Error checking chunk in DB: %s", err.Error())
+			return "", NewOperationError(InternalError, err.Error())
+		}
+		if !exists {
+			if err := mw.s.writeChunk(h, chunk); err != nil {
+				log.Errorf("Error writing chunk to DB: %s", err.Error())
+				return "", NewOperationError(InternalError, err.Error())
+			}
+		}
+		mw.known[h] = true
+	}
+	mw.progress()
+	return h, nil
+}
+
+// add stores one entry; the content of regular files is cut into
+// content-defined chunks averaging chunkSize bytes
+func (mw *manifestWriter) add(header *tar.Header, mode os.FileMode, r io.Reader) error {
+	e := ManifestEntry{
+		Path:    header.Name,
+		Mode:    mode,
+		ModTime: header.ModTime,
+	}
+
+	if !mode.IsDir() {
+		ch := newChunker(r, int(mw.chunkSize))
+		for {
+			data, err := ch.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			chunk, err := compressChunk(data)
+			if err != nil {
+				return err
+			}
+			h, err := mw.writeChunk(chunk)
+			if err != nil {
+				return err
+			}
+
+			e.Size += int64(len(data))
+			e.Chunks = append(e.Chunks, h)
+			if !mw.listed[h] {
+				mw.listed[h] = true
+				mw.hashes = append(mw.hashes, h)
+			}
+		}
+	}
+
+	mw.m.Entries = append(mw.m.Entries, e)
+	return nil
+}
+
+// finish stores the manifest and returns the hash list of the archive:
+// the manifest followed by the content chunks
+func (mw *manifestWriter) finish() ([]string, error) {
+	data, err := encodeManifest(&mw.m)
+	if err != nil {
+		return nil, err
+	}
+	h, err := mw.writeChunk(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{h}, mw.hashes...), nil
+}
+
+// appliedManifest returns the entries of the manifest last unpacked to the
+// workspace, nil if there is none
+func appliedManifest(c *Cache) map[string]*ManifestEntry {
+	r, err := c.openMeta("manifest")
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+
+	magic := make([]byte, len(manifestMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, manifestMagic) {
+		return nil
+	}
+	m, err := decodeManifest(r)
+	if err != nil {
+		log.Errorf("Cannot read applied manifest: %s", err.Error())
+		return nil
+	}
+
+	res := make(map[string]*ManifestEntry)
+	for i := range m.Entries {
+		res[m.Entries[i].Path] = &m.Entries[i]
+	}
+	return res
+}
+
+// setAppliedManifest records the manifest unpacked to the workspace; nil
+// forgets it
+func setAppliedManifest(c *Cache, m *Manifest) error {
+	if m == nil {
+		return c.removeMeta("manifest")
+	}
+	data, err := encodeManifest(m)
+	if err != nil {
+		return err
+	}
+	return c.writeMeta("manifest", data)
+}
+
+// unpackManifest is unpack for a format 3 archive. An entry whose content
+// changed since the last unpack is rewritten even if its time did not, an
+// unchanged one is left alone unless it has been touched in the workspace.
+func unpackManifest(m *Manifest, open ChunkOpener, c *Cache, w *Workspace, replace bool, older bool, paths []string) error {
+	applied := appliedManifest(c)
+
+	existingEntries := make(map[string]bool)
+
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		existingEntries[e.Path] = true
+		if !selectedPath(e.Path, paths) && !(e.Mode.IsDir() && parentOfPaths(e.Path, paths)) {
+			continue
+		}
+
+		force := replace || (applied != nil && !e.sameContent(applied[e.Path]))
+		r := e.open(open)
+		err := w.WriteEntry(e.Path, e.Mode, e.ModTime, r, force, older)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	w.RemoveAll(func(path string) bool {
+		_, ok := existingEntries[path]
+		return !ok && selectedPath(path, paths)
+	})
+
+	if len(paths) == 0 {
+		if err := setAppliedManifest(c, m); err != nil {
+			log.Errorf("Cannot record applied manifest: %s", err.Error())
+		}
+	}
+
+	return nil
+}
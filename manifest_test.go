@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// memStore is a ChunkStore in memory
+type memStore map[string][]byte
+
+func (s memStore) readChunk(h string) ([]byte, error) {
+	data, ok := s[h]
+	if !ok {
+		return nil, fmt.Errorf("No chunk %s", h)
+	}
+	return data, nil
+}
+
+func (s memStore) writeChunk(h string, data []byte) error {
+	s[h] = data
+	return nil
+}
+
+func (s memStore) touchChunk(h string) (bool, error) {
+	_, ok := s[h]
+	return ok, nil
+}
+
+func (s memStore) open(h string) (io.ReadCloser, error) {
+	data, err := s.readChunk(h)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestManifestEncoding(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		m    Manifest
+	}{
+		{"empty", Manifest{Entries: []ManifestEntry{}}},
+		{"dir", Manifest{Entries: []ManifestEntry{
+			{Path: "etc", Mode: os.ModeDir | 0755, ModTime: mtime},
+		}}},
+		{"files", Manifest{Entries: []ManifestEntry{
+			{Path: "etc", Mode: os.ModeDir | 0755, ModTime: mtime},
+			{Path: "etc/a.conf", Mode: 0644, ModTime: mtime, Size: 3, Chunks: []string{"aa"}},
+			{Path: "etc/empty", Mode: 0600, ModTime: mtime},
+			{Path: "etc/b c/ü.yaml", Mode: 0640, ModTime: mtime, Size: 10, Chunks: []string{"bb", "cc", "bb"}},
+		}}},
+	}
+	for _, test := range tests {
+		data, err := encodeManifest(&test.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, manifestMagic) {
+			t.Errorf("%s: no manifest magic", test.name)
+			continue
+		}
+
+		m, err := readManifest([]string{"m"}, memStore{"m": data}.open)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, &test.m) {
+			t.Errorf("%s: decoded %+v, want %+v", test.name, m, &test.m)
+		}
+	}
+}
+
+func TestReadManifestLegacy(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tar.NewWriter(gz).Close()
+	gz.Close()
+
+	m, err := readManifest([]string{"old"}, memStore{"old": buf.Bytes()}.open)
+	if err != nil || m != nil {
+		t.Errorf("tar archive read as manifest %+v, %v", m, err)
+	}
+	if m, err := readManifest(nil, memStore{}.open); err != nil || m != nil {
+		t.Errorf("empty hash list read as manifest %+v, %v", m, err)
+	}
+}
+
+func TestManifestWriter(t *testing.T) {
+	shared := randomData(100000)
+	files := []struct {
+		name string
+		mode os.FileMode
+		data []byte
+	}{
+		{"etc", os.ModeDir | 0755, nil},
+		{"etc/a", 0644, []byte("hello\n")},
+		{"etc/empty", 0644, []byte{}},
+		{"etc/big", 0600, shared},
+		{"etc/copy", 0600, shared},
+	}
+
+	store := memStore{}
+	mw := newManifestWriter(store, 4096, nil, func() {})
+	for _, f := range files {
+		header := &tar.Header{Name: f.name, Size: int64(len(f.data))}
+		if err := mw.add(header, f.mode, bytes.NewReader(f.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashes, err := mw.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, h := range hashes {
+		if seen[h] {
+			t.Errorf("chunk %s listed twice", h)
+		}
+		seen[h] = true
+	}
+	if len(store) != len(hashes) {
+		t.Errorf("%d chunks stored, %d listed", len(store), len(hashes))
+	}
+
+	m, err := readManifest(hashes, store.open)
+	if err != nil || m == nil {
+		t.Fatalf("cannot read manifest: %v", err)
+	}
+	if !reflect.DeepEqual(m.Entries[3].Chunks, m.Entries[4].Chunks) {
+		t.Errorf("same content cut into different chunks")
+	}
+
+	i := 0
+	if err := m.walk(store.open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		f := files[i]
+		i++
+		if header.Name != f.name || mode != f.mode {
+			t.Errorf("entry %s %v, want %s %v", header.Name, mode, f.name, f.mode)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, f.data) && !(len(data) == 0 && len(f.data) == 0) {
+			t.Errorf("%s: read %d bytes, want %d", f.name, len(data), len(f.data))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(files) {
+		t.Errorf("%d entries walked, want %d", i, len(files))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(sys *System) int64
+}
+
+var metrics = []metric{
+	{"dcd_health_checks_total", "counter", "Health checks run after updates.",
+		func(sys *System) int64 { return sys.Health().Checks }},
+	{"dcd_health_check_failures_total", "counter", "Health checks which failed.",
+		func(sys *System) int64 { return sys.Health().Failures }},
+	{"dcd_health_restores_total", "counter", "Previous versions restored after a failed health check.",
+		func(sys *System) int64 { return sys.Health().Restores }},
+	{"dcd_bad_versions", "gauge", "Versions marked bad on this node.",
+		func(sys *System) int64 { return int64(len(sys.Health().Bad)) }},
+}
+
+// writeMetrics writes the metrics of all files in the Prometheus text
+// exposition format
+func writeMetrics(w io.Writer, systems map[string]*System) {
+	files := make([]string, 0, len(systems))
+	for file := range systems {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, file := range files {
+			fmt.Fprintf(w, "%s{file=%q} %d\n", m.name, file, m.value(systems[file]))
+		}
+	}
+}
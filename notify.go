@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// notifyMagic starts every notification datagram
+var notifyMagic = []byte("dcd-notify\n")
+
+// Notifier tells peer daemons about new versions over UDP so that they poll
+// at once instead of on their next update loop. A notification only names
+// the file, so a lost one delays an update until the next loop and a forged
+// one costs a head read. Notifications are only accepted from the hosts of
+// the peers; as source addresses are easily forged, the listening port should
+// still not be reachable from outside the cluster.
+type Notifier struct {
+	conn  *net.UDPConn
+	peers []*net.UDPAddr
+}
+
+// NewNotifier listens for notifications on listen, if set, and sends them
+// to peers
+func NewNotifier(listen string, peers []string) (*Notifier, error) {
+	if listen != "" && len(peers) == 0 {
+		return nil, fmt.Errorf("Notifications are only accepted from peers, give the peers to listen to")
+	}
+
+	n := &Notifier{
+		peers: make([]*net.UDPAddr, 0, len(peers)),
+	}
+
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, err
+		}
+		n.peers = append(n.peers, addr)
+	}
+
+	laddr := &net.UDPAddr{}
+	if listen != "" {
+		var err error
+		if laddr, err = net.ResolveUDPAddr("udp", listen); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+
+	return n, nil
+}
+
+// notify sends a notification about file to all peers
+func (n *Notifier) notify(file string) {
+	if n == nil {
+		return
+	}
+
+	msg := append(append([]byte{}, notifyMagic...), file...)
+	for _, p := range n.peers {
+		if _, err := n.conn.WriteToUDP(msg, p); err != nil {
+			log.Errorf("Cannot notify %s: %s", p, err.Error())
+		}
+	}
+}
+
+// serve has the update loops of the files named by the notifications
+// received poll at once
+func (n *Notifier) serve(repos *Repos) {
+	buf := make([]byte, 4096)
+	for {
+		l, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Errorf("Cannot receive notification: %s", err.Error())
+			return
+		}
+		if !n.fromPeer(addr) {
+			log.Debugf("Ignoring notification from %s, not a peer", addr)
+			continue
+		}
+		if !bytes.HasPrefix(buf[:l], notifyMagic) {
+			continue
+		}
+
+		file := string(buf[len(notifyMagic):l])
+		if sys, ok := repos.get(file); ok {
+			log.Debugf("Notified about %s by %s", file, addr)
+			sys.notified()
+		}
+	}
+}
+
+// fromPeer tells whether addr is on the host of a peer
+func (n *Notifier) fromPeer(addr *net.UDPAddr) bool {
+	for _, p := range n.peers {
+		if p.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) Close() error {
+	return n.conn.Close()
+}
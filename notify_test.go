@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	if _, err := NewNotifier("127.0.0.1:0", nil); err == nil {
+		t.Errorf("listening without peers")
+	}
+
+	// the peer is this host, the notifier listens on an ephemeral port
+	n, err := NewNotifier("127.0.0.1:0", []string{"127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	addr := n.conn.LocalAddr().(*net.UDPAddr)
+
+	sys := newTestSystem(t)
+	repos := NewRepos(nil, "")
+	repos.systems["/test.tgz"] = sys
+	go n.serve(repos)
+
+	send := func(from string, msg string) {
+		conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP(from)}, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notified := func() bool {
+		select {
+		case <-sys.loop.notify:
+			return true
+		case <-time.After(200 * time.Millisecond):
+			return false
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from     string
+		msg      string
+		notified bool
+	}{
+		{"peer", "127.0.0.1", "dcd-notify\n/test.tgz", true},
+		{"unknown file", "127.0.0.1", "dcd-notify\n/other.tgz", false},
+		{"no magic", "127.0.0.1", "/test.tgz", false},
+		{"not a peer", "127.0.0.2", "dcd-notify\n/test.tgz", false},
+	}
+	for _, test := range tests {
+		send(test.from, test.msg)
+		if got := notified(); got != test.notified {
+			t.Errorf("%s: notified %v, want %v", test.name, got, test.notified)
+		}
+	}
+}
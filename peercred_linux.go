@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// peerUid returns the uid of the process on the other end of a unix socket
+func peerUid(conn net.Conn) (int, bool) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, false
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return 0, false
+	}
+	return int(cred.Uid), true
+}
+
+// peerUser returns the name of the user on the other end of a unix socket
+func peerUser(conn net.Conn) string {
+	id, ok := peerUid(conn)
+	if !ok {
+		return ""
+	}
+
+	uid := strconv.Itoa(id)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return "uid=" + uid
+}
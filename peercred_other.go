@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// peerUid is not supported on this platform
+func peerUid(conn net.Conn) (int, bool) {
+	return 0, false
+}
+
+// peerUser is not supported on this platform
+func peerUser(conn net.Conn) string {
+	return ""
+}
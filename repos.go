@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RepoOpener creates the system of a configured repo
+type RepoOpener func(rc RepoConfig) (*System, error)
+
+// RepoStatus describes a repo served
+type RepoStatus struct {
+	Config RepoConfig `json:"config"`
+	// Added is set for repos added at runtime and not persisted; they are
+	// kept on reloads but lost on restarts
+	Added  bool          `json:"added,omitempty"`
+	Update *UpdateStatus `json:"update"`
+}
+
+// Repos holds the systems of the files served. The set changes when the
+// configuration is reloaded or repos are added or removed at runtime;
+// requests in progress keep the system they looked up.
+type Repos struct {
+	lock    *sync.RWMutex
+	systems map[string]*System
+	configs map[string]RepoConfig
+	added   map[string]bool
+	// changing serializes changes of the set
+	changing *sync.Mutex
+	open     RepoOpener
+	// configFile receives the repos persisted, if set
+	configFile string
+}
+
+func NewRepos(open RepoOpener, configFile string) *Repos {
+	return &Repos{
+		lock:       &sync.RWMutex{},
+		systems:    make(map[string]*System),
+		configs:    make(map[string]RepoConfig),
+		added:      make(map[string]bool),
+		changing:   &sync.Mutex{},
+		open:       open,
+		configFile: configFile,
+	}
+}
+
+func (r *Repos) get(file string) (*System, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	sys, ok := r.systems[file]
+	return sys, ok
+}
+
+// all returns the systems of all files
+func (r *Repos) all() map[string]*System {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	res := make(map[string]*System, len(r.systems))
+	for file, sys := range r.systems {
+		res[file] = sys
+	}
+	return res
+}
+
+// List describes the repos served, sorted by file
+func (r *Repos) List() []RepoStatus {
+	r.lock.RLock()
+	res := make([]RepoStatus, 0, len(r.systems))
+	systems := make([]*System, 0, len(r.systems))
+	for file, sys := range r.systems {
+		res = append(res, RepoStatus{
+			Config: r.configs[file],
+			Added:  r.added[file],
+		})
+		systems = append(systems, sys)
+	}
+	r.lock.RUnlock()
+
+	// the update status waits for the operation in progress
+	for i, sys := range systems {
+		res[i].Update = sys.UpdateStatus()
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Config.File < res[j].Config.File
+	})
+	return res
+}
+
+// apply makes the configured repos match configs: repos no longer
+// configured are stopped, new ones started and changed ones restarted with
+// the new settings. A repo which cannot be opened keeps its old settings.
+// Repos added at runtime are left alone unless configured.
+func (r *Repos) apply(configs []RepoConfig) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	wanted := make(map[string]RepoConfig, len(configs))
+	for _, rc := range configs {
+		if _, ok := wanted[rc.File]; ok {
+			return fmt.Errorf("Repo %s is configured twice", rc.File)
+		}
+		wanted[rc.File] = rc
+	}
+
+	r.lock.RLock()
+	removed := make([]string, 0)
+	for file := range r.systems {
+		if _, ok := wanted[file]; !ok && !r.added[file] {
+			removed = append(removed, file)
+		}
+	}
+	r.lock.RUnlock()
+	for _, file := range removed {
+		r.stop(file)
+	}
+
+	failures := make([]string, 0)
+	for _, rc := range configs {
+		if err := r.start(rc, false); err != nil {
+			log.Errorf("Cannot open repo %s: %s", rc.File, err.Error())
+			failures = append(failures, fmt.Sprintf("%s: %s", rc.File, err.Error()))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Cannot open repos:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// Add starts serving a repo and, if persist is set, adds it to the
+// configuration file
+func (r *Repos) Add(rc RepoConfig, persist bool) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	if _, ok := r.get(rc.File); ok {
+		return NewOperationError(InvalidRequest, fmt.Sprintf("Repo %s is served already", rc.File))
+	}
+	if persist && r.configFile == "" {
+		return NewOperationError(InvalidRequest, "Cannot persist without a configuration file, see -config")
+	}
+
+	if err := r.start(rc, !persist); err != nil {
+		log.Errorf("Cannot open repo %s: %s", rc.File, err.Error())
+		return NewOperationError(InvalidRequest, fmt.Sprintf("Cannot open repo %s: %s", rc.File, err.Error()))
+	}
+
+	if persist {
+		if err := r.persist(rc.File, &rc); err != nil {
+			log.Errorf("Cannot persist repo %s: %s", rc.File, err.Error())
+			r.stop(rc.File)
+			return NewOperationError(InternalError, err.Error())
+		}
+	}
+	return nil
+}
+
+// Remove stops serving a repo and, if persist is set, removes it from the
+// configuration file. A repo configured on the command line or left in the
+// configuration file is served again after a restart.
+func (r *Repos) Remove(file string, persist bool) error {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	if _, ok := r.get(file); !ok {
+		return NewOperationError(UnknownFile, fmt.Sprintf("Unknown file: %s", file))
+	}
+	if persist {
+		if r.configFile == "" {
+			return NewOperationError(InvalidRequest, "Cannot persist without a configuration file, see -config")
+		}
+		if err := r.persist(file, nil); err != nil {
+			log.Errorf("Cannot persist removal of repo %s: %s", file, err.Error())
+			return NewOperationError(InternalError, err.Error())
+		}
+	}
+
+	r.stop(file)
+	return nil
+}
+
+// start opens a repo and starts its update loop; the system serving the
+// file already is replaced if its configuration differs
+func (r *Repos) start(rc RepoConfig, added bool) error {
+	r.lock.RLock()
+	old, ok := r.systems[rc.File]
+	same := ok && reflect.DeepEqual(r.configs[rc.File], rc)
+	r.lock.RUnlock()
+
+	if !same {
+		sys, err := r.open(rc)
+		if err != nil {
+			return err
+		}
+
+		if old != nil {
+			log.Infof("Reconfiguring repo %s", rc.File)
+			old.Stop()
+			sys.adopt(old)
+		} else {
+			log.Infof("Adding repo %s", rc.File)
+		}
+		sys.startUpdates()
+
+		r.lock.Lock()
+		r.systems[rc.File] = sys
+		r.configs[rc.File] = rc
+		r.lock.Unlock()
+	}
+
+	r.lock.Lock()
+	r.added[rc.File] = added
+	r.lock.Unlock()
+	return nil
+}
+
+// stop stops serving a repo; its watchers are disconnected
+func (r *Repos) stop(file string) {
+	r.lock.Lock()
+	sys := r.systems[file]
+	delete(r.systems, file)
+	delete(r.configs, file)
+	delete(r.added, file)
+	r.lock.Unlock()
+
+	if sys != nil {
+		log.Infof("Removing repo %s", file)
+		sys.Stop()
+		sys.hooks.watchers.closeAll()
+	}
+}
+
+// persist replaces the repo of file in the configuration file by rc, or
+// removes it if rc is nil
+func (r *Repos) persist(file string, rc *RepoConfig) error {
+	config, err := loadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+
+	repos := make([]RepoConfig, 0, len(config.Repos)+1)
+	for _, repo := range config.Repos {
+		if repo.File != file {
+			repos = append(repos, repo)
+		}
+	}
+	if rc != nil {
+		repos = append(repos, *rc)
+	}
+	config.Repos = repos
+
+	return saveConfig(r.configFile, config)
+}
+
+// Stop stops the update loops of all repos
+func (r *Repos) Stop() {
+	for _, sys := range r.all() {
+		sys.Stop()
+	}
+}
+
+// adopt takes over from the system of the same file replaced on a
+// reconfiguration. The lock is shared so that operations still running on
+// the old system finish before the new one touches the workspace; hook
+// results, health counters and watchers carry over.
+func (sys *System) adopt(old *System) {
+	sys.lock = old.lock
+
+	old.hooks.lock.Lock()
+	defer old.hooks.lock.Unlock()
+	sys.hooks.lock.Lock()
+	defer sys.hooks.lock.Unlock()
+
+	for hook, res := range old.hooks.results {
+		sys.hooks.results[hook] = res
+	}
+	sys.hooks.health = old.hooks.health
+	sys.hooks.watchers = old.hooks.watchers
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testOpener opens repos on a file backend shared by all of them
+func testOpener(t *testing.T) RepoOpener {
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(rc RepoConfig) (*System, error) {
+		s, err := backend.Open(rc.File, StorageOptions{Retention: HistoryRetention{Keep: 10}})
+		if err != nil {
+			return nil, err
+		}
+		c := &Cache{CacheDir: rc.Cache, ChunkSize: 65536, Owner: rc.File}
+		if err := c.initCache(); err != nil {
+			return nil, err
+		}
+		return NewSystem(s, c, &Workspace{Root: rc.Workspace}, SystemOptions{}), nil
+	}
+}
+
+// testRepo returns the configuration of a repo in temporary directories
+func testRepo(t *testing.T, file string) RepoConfig {
+	dir := t.TempDir()
+	return RepoConfig{
+		File:      file,
+		Workspace: filepath.Join(dir, "ws"),
+		Cache:     filepath.Join(dir, "cache"),
+	}
+}
+
+// listed returns the files served and whether they were added at runtime
+func listed(r *Repos) map[string]bool {
+	res := make(map[string]bool)
+	for _, repo := range r.List() {
+		res[repo.Config.File] = repo.Added
+	}
+	return res
+}
+
+func TestReposAddRemove(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "dcd.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("repos: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRepos(testOpener(t), configFile)
+	defer r.Stop()
+
+	persisted := func() []string {
+		config, err := loadConfig(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make([]string, 0)
+		for _, rc := range config.Repos {
+			res = append(res, rc.File)
+		}
+		return res
+	}
+
+	a, b := testRepo(t, "/a.tgz"), testRepo(t, "/b.tgz")
+	if err := r.Add(a, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(a, false); GetErrorType(err) != InvalidRequest {
+		t.Errorf("adding a repo twice: %v", err)
+	}
+	if err := r.Add(b, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(r); len(got) != 2 || !got["/a.tgz"] || got["/b.tgz"] {
+		t.Errorf("listed %v, want /a.tgz added and /b.tgz persisted", got)
+	}
+	if got := persisted(); len(got) != 1 || got[0] != "/b.tgz" {
+		t.Errorf("persisted %v, want /b.tgz", got)
+	}
+
+	if err := r.Remove("/a.tgz", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove("/a.tgz", false); GetErrorType(err) != UnknownFile {
+		t.Errorf("removing a repo twice: %v", err)
+	}
+	if err := r.Remove("/b.tgz", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(r); len(got) != 0 {
+		t.Errorf("listed %v after removing all", got)
+	}
+	if got := persisted(); len(got) != 0 {
+		t.Errorf("persisted %v after removing all", got)
+	}
+}
+
+func TestReposPersistWithoutConfig(t *testing.T) {
+	r := NewRepos(testOpener(t), "")
+	defer r.Stop()
+
+	if err := r.Add(testRepo(t, "/a.tgz"), true); GetErrorType(err) != InvalidRequest {
+		t.Errorf("persisting without a configuration file: %v", err)
+	}
+	if got := listed(r); len(got) != 0 {
+		t.Errorf("listed %v after a failed add", got)
+	}
+}
+
+func TestReposApply(t *testing.T) {
+	r := NewRepos(testOpener(t), "")
+	defer r.Stop()
+
+	a, b, c := testRepo(t, "/a.tgz"), testRepo(t, "/b.tgz"), testRepo(t, "/c.tgz")
+	if err := r.apply([]RepoConfig{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(c, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(r); len(got) != 3 || got["/a.tgz"] || got["/b.tgz"] || !got["/c.tgz"] {
+		t.Errorf("listed %v, want /a.tgz and /b.tgz configured and /c.tgz added", got)
+	}
+	if err := r.apply([]RepoConfig{a, a}); err == nil {
+		t.Errorf("applied a repo configured twice")
+	}
+
+	oldA, _ := r.get("/a.tgz")
+	oldB, _ := r.get("/b.tgz")
+	aEvents, cancel := oldA.hooks.watch()
+	defer cancel()
+	bEvents, _ := oldB.hooks.watch()
+
+	// an operation on /a.tgz is in flight while /b.tgz is removed and
+	// /a.tgz reconfigured
+	oldA.lock.Lock()
+	a.Interval = "1h"
+	applied := make(chan error, 1)
+	go func() {
+		applied <- r.apply([]RepoConfig{a})
+	}()
+
+	select {
+	case err := <-applied:
+		t.Fatalf("reconfigured during an operation: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if sys, _ := r.get("/a.tgz"); sys != oldA {
+		t.Errorf("/a.tgz replaced during an operation")
+	}
+	oldA.lock.Unlock()
+
+	select {
+	case err := <-applied:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconfiguration does not finish")
+	}
+
+	if got := listed(r); len(got) != 2 || got["/a.tgz"] || !got["/c.tgz"] {
+		t.Errorf("listed %v, want /a.tgz configured and /c.tgz added", got)
+	}
+	if _, ok := <-bEvents; ok {
+		t.Errorf("watcher of the removed /b.tgz not disconnected")
+	}
+
+	newA, _ := r.get("/a.tgz")
+	if newA == oldA || newA.lock != oldA.lock || !oldA.loop.stopped {
+		t.Errorf("/a.tgz not restarted on the lock of the old system")
+	}
+	newA.hooks.emit("a", "b", nil)
+	select {
+	case event := <-aEvents:
+		if event.NewHash != "b" {
+			t.Errorf("event %+v, want new hash b", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("watcher of /a.tgz lost on reconfiguration")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Pin freezes the workspace of this node on a version
+type Pin struct {
+	Version string    `json:"version"`
+	Reason  string    `json:"reason,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// targets tells whether the version is rolled out to a node carrying the
+// labels; versions without a target are rolled out to every node
+func (v *Version) targets(labels []string) bool {
+	if len(v.Target) == 0 {
+		return true
+	}
+	for _, t := range v.Target {
+		for _, l := range labels {
+			if t == l {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pinned returns the pin of the workspace, nil if it is not pinned
+func (sys *System) pinned() *Pin {
+	r, err := sys.c.openMeta("pin")
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+
+	var pin Pin
+	if err := json.NewDecoder(r).Decode(&pin); err != nil {
+		log.Errorf("Cannot read pin: %s", err.Error())
+		return nil
+	}
+	return &pin
+}
+
+// nodeVersion returns the version the workspace of this node follows: the
+// pinned version or else the newest version targeted at the node. The hash
+// list is nil if no retained version is targeted at the node or the pinned
+// version has been pruned from the history; the workspace is then left alone.
+func (sys *System) nodeVersion() (string, []string, error) {
+	if pin := sys.pinned(); pin != nil {
+		hashes, err := sys.s.getVersionHashes(pin.Version)
+		if GetErrorType(err) == UnknownVersion {
+			return pin.Version, nil, nil
+		}
+		return pin.Version, hashes, err
+	}
+
+	head, hashes, err := sys.s.getHead()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if head != sys.rollout.head {
+		// the history is only read when the head changes
+		version, err := sys.targetVersion(head)
+		if err != nil {
+			return "", nil, err
+		}
+		sys.rollout.head = head
+		sys.rollout.version = version
+	}
+
+	switch sys.rollout.version {
+	case head:
+		return head, hashes, nil
+	case "":
+		return "", nil, nil
+	}
+	hashes, err = sys.s.getVersionHashes(sys.rollout.version)
+	return sys.rollout.version, hashes, err
+}
+
+// targetVersion returns the newest version up to head targeted at the node
+func (sys *System) targetVersion(head string) (string, error) {
+	versions, err := sys.s.listVersions()
+	if err != nil {
+		return "", err
+	}
+
+	found := false
+	for _, v := range versions {
+		found = found || v.Version == head
+		if found && v.targets(sys.opts.Labels) {
+			return v.Version, nil
+		}
+	}
+	if !found {
+		// written before history was kept
+		return head, nil
+	}
+	return "", nil
+}
+
+// Promote rolls the current version out to all nodes by committing it
+// again without a target
+func (sys *System) Promote(info CommitInfo, ph *ProgressHandler) error {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	current, hashes, err := sys.s.getHead()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, "Cannot get the hash list from DB")
+	}
+
+	versions, err := sys.s.listVersions()
+	if err != nil {
+		log.Errorf("Cannot list history: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	staged := false
+	for _, v := range versions {
+		if v.Version == current {
+			staged = len(v.Target) > 0
+		}
+	}
+	if !staged {
+		return NewOperationError(InvalidRequest, "The current version is rolled out to all nodes already")
+	}
+
+	if info.Message == "" {
+		info.Message = "Promote version " + current
+	}
+	info.Target = nil
+
+	return sys.publish(current, hashes, hashes, info, 0, ph)
+}
+
+// Pin freezes the workspace of this node on version. The pin is recorded in
+// the storage as well, so that the history retains the version while it is
+// pinned.
+func (sys *System) Pin(version string, reason string, user string, ph *ProgressHandler) (err error) {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+	// recorded first, the version is not pruned once found retained below
+	if err := sys.s.setPin(hostname, version); err != nil {
+		log.Errorf("Cannot record pin in DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	defer func() {
+		if err != nil {
+			sys.restorePin(hostname)
+		}
+	}()
+
+	versions, err := sys.s.listVersions()
+	if err != nil {
+		log.Errorf("Cannot list history from DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	retained := false
+	for _, v := range versions {
+		retained = retained || v.Version == version
+	}
+	if !retained {
+		return NewOperationError(UnknownVersion, fmt.Sprintf("File %s: Version %s is not retained in the history", sys.c.Owner, version))
+	}
+
+	hashes, err := sys.s.getVersionHashes(version)
+	if err != nil {
+		if GetErrorType(err) == UnknownVersion {
+			return err
+		}
+		log.Errorf("Cannot get hash list of version %s from DB: %s", version, err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	data, err := json.Marshal(&Pin{
+		Version: version,
+		Reason:  reason,
+		User:    user,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+	if err := sys.c.writeMeta("pin", data); err != nil {
+		log.Errorf("Cannot write pin: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	if _, err := updateWorkspace(sys.s, sys.c, sys.w, sys.hooks, hashes, true, false, false, ph); err != nil {
+		log.Errorf("Cannot update workspace: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	return nil
+}
+
+// restorePin records the pin kept in the cache meta data, if any, in the
+// storage again after a failed Pin
+func (sys *System) restorePin(hostname string) {
+	version := ""
+	if pin := sys.pinned(); pin != nil {
+		version = pin.Version
+	}
+	if err := sys.s.setPin(hostname, version); err != nil {
+		log.Errorf("Cannot restore pin: %s", err.Error())
+	}
+}
+
+// Unpin lets the workspace of this node follow the rollout again
+func (sys *System) Unpin(ph *ProgressHandler) error {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	if err := sys.c.removeMeta("pin"); err != nil {
+		log.Errorf("Cannot remove pin: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+	if err := sys.s.setPin(hostname, ""); err != nil {
+		log.Errorf("Cannot remove pin from DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	_, hashes, err := sys.nodeVersion()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	if hashes == nil {
+		return nil
+	}
+
+	if _, err := updateWorkspace(sys.s, sys.c, sys.w, sys.hooks, hashes, true, false, false, ph); err != nil {
+		log.Errorf("Cannot update workspace: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// testBackends returns the file backend and, if DCD_TEST_CASSANDRA names a
+// backend URI such as cassandra://localhost/dconf_test, the Cassandra one
+func testBackends(t *testing.T) map[string]StorageBackend {
+	backends := make(map[string]StorageBackend)
+
+	fb, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends["file"] = fb
+
+	if uri := os.Getenv("DCD_TEST_CASSANDRA"); uri != "" {
+		cb, err := OpenStorageBackend(uri, gocql.Quorum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cb.Close)
+		backends["cassandra"] = cb
+	}
+	return backends
+}
+
+func TestNodeVersion(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			file := fmt.Sprintf("/rollout-%d.tgz", time.Now().UnixNano())
+			s, err := backend.Open(file, StorageOptions{Retention: HistoryRetention{Keep: 10}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			commit := func(old []string, hashes []string, target []string) string {
+				expected, err := s.getHeadVersion()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.setHashes(expected, old, hashes, CommitInfo{Target: target}, func() {}); err != nil {
+					t.Fatal(err)
+				}
+				version, err := s.getHeadVersion()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return version
+			}
+			v1Hashes := []string{"1111"}
+			v2Hashes := []string{"2222"}
+			v1 := commit(nil, v1Hashes, nil)
+			v2 := commit(v1Hashes, v2Hashes, []string{"canary"})
+
+			versions, err := s.listVersions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 || !reflect.DeepEqual(versions[0].Target, []string{"canary"}) || len(versions[1].Target) != 0 {
+				t.Fatalf("history does not keep the targets: %+v", versions)
+			}
+
+			tests := []struct {
+				labels  []string
+				version string
+				hashes  []string
+			}{
+				{[]string{"canary"}, v2, v2Hashes},
+				{[]string{"eu", "canary"}, v2, v2Hashes},
+				{[]string{"eu"}, v1, v1Hashes},
+				{nil, v1, v1Hashes},
+			}
+			for _, test := range tests {
+				sys := NewSystem(s, &Cache{CacheDir: t.TempDir(), Owner: file}, &Workspace{Root: t.TempDir()}, SystemOptions{
+					Labels: test.labels,
+				})
+				version, hashes, err := sys.nodeVersion()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if version != test.version || !reflect.DeepEqual(hashes, test.hashes) {
+					t.Errorf("labels %v: got version %s %v, want %s %v", test.labels, version, hashes, test.version, test.hashes)
+				}
+			}
+		})
+	}
+}
+
+func TestRetainFollowedVersions(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			file := fmt.Sprintf("/retain-%d.tgz", time.Now().UnixNano())
+			s, err := backend.Open(file, StorageOptions{Retention: HistoryRetention{Keep: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var hashes []string
+			commit := func(target ...string) string {
+				expected, err := s.getHeadVersion()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// a legacy archive, so that the pinned version can be unpacked
+				data := archive(t, map[string]string{"a": expected})
+				sum := sha256.Sum256(data)
+				newHashes := []string{hashToStr(sum[:])}
+				if err := s.writeChunk(newHashes[0], data); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.setHashes(expected, hashes, newHashes, CommitInfo{Target: target}, func() {}); err != nil {
+					t.Fatal(err)
+				}
+				hashes = newHashes
+				version, err := s.getHeadVersion()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return version
+			}
+			retained := func() []string {
+				versions, err := s.listVersions()
+				if err != nil {
+					t.Fatal(err)
+				}
+				res := make([]string, 0)
+				for _, v := range versions {
+					res = append(res, v.Version)
+				}
+				return res
+			}
+
+			v0 := commit()
+			sys := NewSystem(s, &Cache{CacheDir: t.TempDir(), Owner: file}, &Workspace{Root: t.TempDir()}, SystemOptions{})
+			if err := sys.Pin(v0, "test", "test", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			v1 := commit()
+			commit("canary")
+			v3 := commit("eu")
+			v4 := commit("canary")
+
+			// the pinned version, the newest one for all nodes and the
+			// newest one of every label
+			if versions := retained(); !reflect.DeepEqual(versions, []string{v4, v3, v1, v0}) {
+				t.Errorf("retained %v, want %v", versions, []string{v4, v3, v1, v0})
+			}
+
+			if err := sys.Unpin(nil); err != nil {
+				t.Fatal(err)
+			}
+			pinned, err := s.pinnedVersions()
+			if err != nil || len(pinned) != 0 {
+				t.Errorf("pins after unpin: %v, %v", pinned, err)
+			}
+
+			v5 := commit("canary")
+			if versions := retained(); !reflect.DeepEqual(versions, []string{v5, v3, v1}) {
+				t.Errorf("retained %v after unpin, want %v", versions, []string{v5, v3, v1})
+			}
+		})
+	}
+}
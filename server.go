@@ -1,29 +1,37 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 )
 
+type connContextKey struct{}
+
 type HttpServer struct {
 	socket  string
 	port    int
 	_type   string
-	systems map[string]*System
+	systems *Repos
+	gc      *Collector
 	// progress handlers
 	progressHandlers map[string]*ProgressHandler
 	phMutex          *sync.Mutex
 }
 
-func NewHttpServerUnixSocket(socket string, systems map[string]*System) *HttpServer {
+func NewHttpServerUnixSocket(socket string, systems *Repos, gc *Collector) *HttpServer {
 	return &HttpServer{
 		_type:            "unix",
 		socket:           socket,
 		systems:          systems,
+		gc:               gc,
 		progressHandlers: make(map[string]*ProgressHandler),
 		phMutex:          &sync.Mutex{},
 	}
@@ -51,7 +59,14 @@ func (s *HttpServer) Serve() error {
 	}
 	defer listener.Close()
 
-	return http.Serve(listener, s)
+	server := &http.Server{
+		Handler: s,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+
+	return server.Serve(listener)
 }
 
 func (s *HttpServer) Close() {
@@ -64,15 +79,55 @@ func (s *HttpServer) handleError(err error, w http.ResponseWriter) {
 	case 1:
 		w.WriteHeader(500)
 		SendJson(w, ErrorMessage{Message: err.Error()})
-	case 2, 3, 4, 6:
+	case 2, 3, 4, 6, 7, 8, 9, 10:
 		w.WriteHeader(400)
 		SendJson(w, ErrorMessage{Message: err.Error()})
+	case 11:
+		w.WriteHeader(403)
+		SendJson(w, ErrorMessage{Message: err.Error()})
 	default:
 		w.WriteHeader(500)
 		SendJson(w, ErrorMessage{Message: err.Error()})
 	}
 }
 
+// peer returns the user name of the process that sent req
+func (s *HttpServer) peer(req *http.Request) string {
+	if conn, ok := req.Context().Value(connContextKey{}).(net.Conn); ok {
+		return peerUser(conn)
+	}
+	return ""
+}
+
+// privileged tells whether req comes from root or the user running the
+// daemon; false if the credentials of the caller are unknown
+func (s *HttpServer) privileged(req *http.Request) bool {
+	conn, ok := req.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+	uid, ok := peerUid(conn)
+	return ok && (uid == 0 || uid == os.Getuid())
+}
+
+// commitInfo describes a commit requested by req; the author is taken from
+// the credentials of the calling process
+func (s *HttpServer) commitInfo(req *http.Request) CommitInfo {
+	info := CommitInfo{
+		Author:  s.peer(req),
+		Message: req.URL.Query().Get("message"),
+	}
+	if target := req.URL.Query().Get("target"); target != "" {
+		info.Target = strings.Split(target, ",")
+	}
+
+	if hostname, err := os.Hostname(); err == nil && info.Author != "" {
+		info.Author += "@" + hostname
+	}
+
+	return info
+}
+
 func SendJson(w http.ResponseWriter, msg interface{}) error {
 	bytes, err := json.Marshal(msg)
 	if err != nil {
@@ -88,7 +143,78 @@ func SendJson(w http.ResponseWriter, msg interface{}) error {
 
 func (s *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	path := req.URL.Path
-	system, ok := s.systems[path]
+	if path == "/" && req.Method == "LOCKS" {
+		s.listLocks(w)
+		return
+	}
+
+	if path == "/" && req.Method == "FSCK" {
+		s.fsckAll(w, req.URL.Query().Get("repair") == "true")
+		return
+	}
+
+	if path == "/" && req.Method == "METRICS" {
+		w.Header().Add("content-type", "text/plain; version=0.0.4")
+		writeMetrics(w, s.systems.all())
+		return
+	}
+
+	if path == "/" && req.Method == "GC" {
+		report, err := s.gc.Run(req.URL.Query().Get("dry_run") == "true")
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, report)
+		return
+	}
+
+	if path == "/" && req.Method == "REPOS" {
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, s.systems.List())
+		return
+	}
+
+	if (req.Method == "ADD" || req.Method == "REMOVE") && !s.privileged(req) {
+		// repos run hooks and validators as the daemon
+		s.handleError(NewOperationError(PermissionDenied, "Only root or the user running the daemon can add and remove repos"), w)
+		return
+	}
+
+	if req.Method == "ADD" {
+		var rc RepoConfig
+		if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+			s.handleError(NewOperationError(InvalidRequest, "Invalid repo configuration: "+err.Error()), w)
+			return
+		}
+		rc.File = path
+		if err := checkFileName(rc.File); err != nil {
+			s.handleError(NewOperationError(InvalidRequest, err.Error()), w)
+			return
+		}
+		if rc.Workspace == "" || rc.Cache == "" {
+			s.handleError(NewOperationError(InvalidRequest, "A repo needs a workspace and a cache"), w)
+			return
+		}
+		if err := s.systems.Add(rc, req.URL.Query().Get("persist") == "true"); err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+
+	if req.Method == "REMOVE" {
+		if err := s.systems.Remove(path, req.URL.Query().Get("persist") == "true"); err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+
+	system, ok := s.systems.get(path)
 	if !ok {
 		s.handleError(NewOperationError(UnknownFile, fmt.Sprintf("Unknown file: %s", path)), w)
 		return
@@ -111,13 +237,13 @@ func (s *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	switch req.Method {
 	case "GET":
-		err := system.Get(w, progressHandler)
+		err := system.Get(req.URL.Query().Get("version"), w, progressHandler)
 		if err != nil {
 			s.handleError(err, w)
 			return
 		}
 	case "EDIT":
-		err := system.Edit(req.URL.Query().Get("force") == "true", progressHandler)
+		err := system.Edit(req.URL.Query().Get("force") == "true", s.peer(req), progressHandler)
 		if err != nil {
 			s.handleError(err, w)
 			return
@@ -128,7 +254,7 @@ func (s *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(200)
 		}
 	case "COMMIT":
-		err := system.Commit(req.URL.Query().Get("force") == "true", progressHandler)
+		err := system.Commit(req.URL.Query().Get("force") == "true", s.commitInfo(req), progressHandler)
 		if err != nil {
 			s.handleError(err, w)
 			return
@@ -149,6 +275,170 @@ func (s *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		} else {
 			w.WriteHeader(200)
 		}
+	case "PUT":
+		defer req.Body.Close()
+		err := system.Put(req.Body, req.URL.Query().Get("force") == "true", req.URL.Query().Get("version"), s.commitInfo(req), progressHandler)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		if progressHandler != nil {
+			progressHandler.SendJson(w)
+		} else {
+			w.WriteHeader(200)
+		}
+	case "PROMOTE":
+		err := system.Promote(s.commitInfo(req), progressHandler)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		if progressHandler != nil {
+			progressHandler.SendJson(w)
+		} else {
+			w.WriteHeader(200)
+		}
+	case "PIN":
+		version := req.URL.Query().Get("version")
+		if version == "" {
+			err := NewOperationError(InvalidRequest, "Missing request parameter `version`")
+			s.handleError(err, w)
+			return
+		}
+		err := system.Pin(version, req.URL.Query().Get("reason"), s.peer(req), progressHandler)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		if progressHandler != nil {
+			progressHandler.SendJson(w)
+		} else {
+			w.WriteHeader(200)
+		}
+	case "UNPIN":
+		err := system.Unpin(progressHandler)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		if progressHandler != nil {
+			progressHandler.SendJson(w)
+		} else {
+			w.WriteHeader(200)
+		}
+	case "LOG":
+		versions, err := system.Log()
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, versions)
+	case "ROLLBACK":
+		version := req.URL.Query().Get("version")
+		if version == "" {
+			err := NewOperationError(InvalidRequest, "Missing request parameter `version`")
+			s.handleError(err, w)
+			return
+		}
+		err := system.Rollback(version, s.commitInfo(req), progressHandler)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		if progressHandler != nil {
+			progressHandler.SendJson(w)
+		} else {
+			w.WriteHeader(200)
+		}
+	case "REVERT":
+		err := system.Revert(req.URL.Query()["path"], progressHandler)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		if progressHandler != nil {
+			progressHandler.SendJson(w)
+		} else {
+			w.WriteHeader(200)
+		}
+	case "CAT":
+		err := system.Cat(req.URL.Query().Get("version"), req.URL.Query().Get("path"), w)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+	case "LS":
+		entries, err := system.List(req.URL.Query().Get("version"), req.URL.Query().Get("path"))
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, entries)
+	case "STATUS":
+		status, err := system.Status()
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, status)
+	case "DIFF":
+		var buf bytes.Buffer
+		if err := system.Diff(&buf); err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.Header().Add("content-type", "text/plain")
+		w.Write(buf.Bytes())
+	case "FSCK":
+		report, err := system.Fsck(req.URL.Query().Get("repair") == "true")
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		report.File = path
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, []*FsckReport{report})
+	case "LOCKS":
+		leases, err := system.Locks()
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, leases)
+	case "HOOKS":
+		w.Header().Add("content-type", "application/json")
+		SendJson(w, system.Hooks())
+	case "WATCH":
+		// one JSON line per event, sent as it happens
+		w.Header().Add("content-type", "application/x-ndjson")
+		w.WriteHeader(200)
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		err := system.Watch(req.Context().Done(), func(event *UpdateEvent) error {
+			if err := json.NewEncoder(w).Encode(event); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Infof("Watcher of %s stopped: %s", path, err.Error())
+		}
+	case "UNLOCK":
+		err := system.Unlock(req.URL.Query().Get("force") == "true")
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		w.WriteHeader(200)
 	case "PROGRESS":
 		if progress == "" {
 			err := NewOperationError(InvalidRequest, "Missing request parameter `progress`")
@@ -165,6 +455,46 @@ func (s *HttpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// fsckAll checks all files served
+func (s *HttpServer) fsckAll(w http.ResponseWriter, repair bool) {
+	systems := s.systems.all()
+	files := make([]string, 0, len(systems))
+	for file := range systems {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	reports := make([]*FsckReport, 0)
+	for _, file := range files {
+		report, err := systems[file].Fsck(repair)
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		report.File = file
+		reports = append(reports, report)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	SendJson(w, reports)
+}
+
+// listLocks sends the leases of all files served
+func (s *HttpServer) listLocks(w http.ResponseWriter) {
+	leases := make([]Lease, 0)
+	for _, system := range s.systems.all() {
+		l, err := system.Locks()
+		if err != nil {
+			s.handleError(err, w)
+			return
+		}
+		leases = append(leases, l...)
+	}
+
+	w.Header().Add("content-type", "application/json")
+	SendJson(w, leases)
+}
+
 func (s *HttpServer) registerProgressHandler(h *ProgressHandler) error {
 	s.phMutex.Lock()
 	defer s.phMutex.Unlock()
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// In atomic mode the workspace root is a symlink to a version directory
+// kept in a hidden sibling directory. A new version is extracted and
+// verified next to the current one and the symlink is then replaced with a
+// rename, so readers see either the old or the new version in full.
+
+// versionsDir returns the sibling directory holding the version directories
+func (w *Workspace) versionsDir() string {
+	root := filepath.Clean(w.Root)
+	return filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".dcd")
+}
+
+// stagingDir creates an empty version directory
+func (w *Workspace) stagingDir() (string, error) {
+	if err := os.MkdirAll(w.versionsDir(), 0755); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(w.versionsDir(), "v")
+	if err != nil {
+		return "", err
+	}
+	return dir, os.Chmod(dir, 0755)
+}
+
+// swap points the workspace root to dir. The version directory the root
+// pointed to before is kept, older ones are removed.
+func (w *Workspace) swap(dir string) error {
+	root := filepath.Clean(w.Root)
+	versions := w.versionsDir()
+
+	previous := ""
+	if target, err := os.Readlink(root); err == nil {
+		previous = filepath.Base(target)
+	}
+
+	link := filepath.Join(versions, "link")
+	os.Remove(link)
+	// relative to the directory of the root, so that the workspace can be moved
+	if err := os.Symlink(filepath.Join(filepath.Base(versions), filepath.Base(dir)), link); err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(root); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// a workspace unpacked before atomic mode was enabled is moved into
+		// the versions directory once; this first switch is not atomic
+		previous = "initial"
+		os.RemoveAll(filepath.Join(versions, previous))
+		if err := os.Rename(root, filepath.Join(versions, previous)); err != nil {
+			os.Remove(link)
+			return err
+		}
+	}
+
+	if err := os.Rename(link, root); err != nil {
+		os.Remove(link)
+		return err
+	}
+	log.Debugf("Switched workspace %s to %s", root, dir)
+
+	files, err := ioutil.ReadDir(versions)
+	if err != nil {
+		return nil
+	}
+	for _, fi := range files {
+		if fi.Name() == filepath.Base(dir) || fi.Name() == previous {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(versions, fi.Name())); err != nil {
+			log.Errorf("Cannot remove old version directory: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// unpackStaged is unpack in atomic mode: the archive is extracted into a
+// new version directory which replaces the current one once every entry has
+// been checked
+func unpackStaged(hashes []string, open ChunkOpener, m *Manifest, c *Cache, w *Workspace) error {
+	dir, err := w.stagingDir()
+	if err != nil {
+		return err
+	}
+	staged := &Workspace{Root: dir, Owner: w.Owner}
+
+	err = w.chown(dir)
+	if err == nil {
+		err = walkArchive(hashes, open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+			return staged.WriteEntry(header.Name, mode, header.ModTime, r, true, false)
+		})
+	}
+	if err == nil {
+		err = verifyStaged(hashes, open, staged)
+	}
+	if err == nil {
+		err = w.swap(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	if err := setAppliedManifest(c, m); err != nil {
+		log.Errorf("Cannot record applied manifest: %s", err.Error())
+	}
+	return nil
+}
+
+// verifyStaged checks that every entry of the archive has been extracted
+// with its type and size
+func verifyStaged(hashes []string, open ChunkOpener, staged *Workspace) error {
+	return walkArchive(hashes, open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		info, err := os.Lstat(staged.getEntry(header.Name))
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != mode.IsDir() || (!mode.IsDir() && info.Size() != header.Size) {
+			return fmt.Errorf("Staged entry %s does not match the archive", header.Name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// versionDirs returns the names of the version directories of w
+func versionDirs(t *testing.T, w *Workspace) []string {
+	files, err := ioutil.ReadDir(w.versionsDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSwap(t *testing.T) {
+	w := &Workspace{Root: filepath.Join(t.TempDir(), "ws"), Atomic: true}
+	// unpacked before atomic mode was enabled
+	if err := os.MkdirAll(w.Root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.Root, "a"), []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dirs := make([]string, 0)
+	for _, data := range []string{"1", "2", "3"} {
+		dir, err := w.stagingDir()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "a"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.swap(dir); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, filepath.Base(dir))
+
+		target, err := os.Readlink(w.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.IsAbs(target) || !strings.HasSuffix(target, filepath.Base(dir)) {
+			t.Errorf("root points to %s", target)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(w.Root, "a"))
+		if err != nil || string(content) != data {
+			t.Errorf("workspace holds %q, %v, want %q", content, err, data)
+		}
+	}
+
+	// the previous version directory is kept, older ones are removed
+	want := []string{dirs[1], dirs[2]}
+	sort.Strings(want)
+	if names := versionDirs(t, w); strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("version directories %v, want %v", names, want)
+	}
+}
+
+func TestUnpackStaged(t *testing.T) {
+	sys := newTestSystem(t)
+	commitFiles(t, sys, map[string]string{"a": "1", "dir/b": "1"})
+
+	sys.w.Atomic = true
+	commitFiles(t, sys, map[string]string{"a": "2"})
+	if err := sys.Update(true, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(sys.w.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("workspace root is not a symlink")
+	}
+	files := readFiles(t, sys)
+	if files["a"] != "2" || files["dir/b"] != "1" || len(files) != 2 {
+		t.Errorf("workspace holds %v", files)
+	}
+	// the current and the previous version
+	if names := versionDirs(t, sys.w); len(names) != 2 {
+		t.Errorf("version directories %v", names)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// entries larger than this are compared by hash only
+const maxDiffSize = 1 << 20
+
+const (
+	Added       = "added"
+	Modified    = "modified"
+	Removed     = "removed"
+	ModeChanged = "mode"
+)
+
+type Change struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+}
+
+type WorkspaceStatus struct {
+	CheckedOut bool `json:"checkedOut"`
+	// Version the workspace is compared with
+	Version string   `json:"version,omitempty"`
+	Changes []Change `json:"changes"`
+	// Head is set to the current version if the node does not follow it
+	Head string `json:"head,omitempty"`
+	Pin  *Pin   `json:"pin,omitempty"`
+	// PinPruned is set if the pinned version is no longer retained
+	PinPruned bool `json:"pinPruned,omitempty"`
+	// Health is set if health checks are configured or versions have been
+	// marked bad
+	Health *HealthStatus `json:"health,omitempty"`
+	Update *UpdateStatus `json:"update"`
+}
+
+type archivedEntry struct {
+	mode os.FileMode
+	hash string
+	data []byte
+}
+
+// baseVersion returns the version the workspace has been checked out from,
+// or the current version if it is no longer retained. A workspace which is
+// not checked out is compared with the version the node follows.
+func (sys *System) baseVersion() (string, []string, error) {
+	chk, err := sys.w.GetCheckout()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if chk == "" {
+		version, hashes, err := sys.nodeVersion()
+		if err != nil || hashes != nil {
+			return version, hashes, err
+		}
+	}
+
+	version, hashes, err := sys.s.getHead()
+	if err != nil || chk == "" {
+		return version, hashes, err
+	}
+
+	if hash, err := contentHash(hashes); err == nil && hash == chk {
+		return version, hashes, nil
+	}
+
+	versions, err := sys.s.listVersions()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, v := range versions {
+		if v.Hash == chk {
+			vHashes, err := sys.s.getVersionHashes(v.Version)
+			if err != nil {
+				return "", nil, err
+			}
+			return v.Version, vHashes, nil
+		}
+	}
+
+	return version, hashes, nil
+}
+
+func hashReader(r io.Reader, keep bool) (string, []byte, error) {
+	hash := sha256.New()
+	if !keep {
+		if _, err := io.Copy(hash, r); err != nil {
+			return "", nil, err
+		}
+		return hashToStr(hash.Sum(nil)), nil, nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+	hash.Write(data)
+	return hashToStr(hash.Sum(nil)), data, nil
+}
+
+// compareWorkspace lists the differences between the workspace and the
+// archive made of hashes; with keepData the archived content of small files
+// is returned as well
+func (sys *System) compareWorkspace(hashes []string, keepData bool) ([]Change, map[string]*archivedEntry, error) {
+	archived := make(map[string]*archivedEntry)
+	if err := walkArchive(hashes, cachedChunkOpener(sys.s, sys.c), func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		e := &archivedEntry{mode: mode}
+		if !mode.IsDir() {
+			h, data, err := hashReader(r, keepData && header.Size <= maxDiffSize)
+			if err != nil {
+				return err
+			}
+			e.hash = h
+			e.data = data
+		}
+		archived[header.Name] = e
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	changes := make([]Change, 0)
+	seen := make(map[string]bool)
+	// the workspace does not exist before the first unpack
+	if _, err := os.Stat(sys.w.Root); err == nil {
+		if err := sys.w.Walk(func(path string, info os.FileInfo, r io.Reader, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path == "." || path == ".dcd" {
+				return nil
+			}
+
+			seen[path] = true
+			e, ok := archived[path]
+			if !ok {
+				changes = append(changes, Change{path, Added})
+				return nil
+			}
+
+			if info.IsDir() != e.mode.IsDir() {
+				changes = append(changes, Change{path, Modified})
+				return nil
+			}
+
+			if !info.IsDir() {
+				h, _, err := hashReader(r, false)
+				if err != nil {
+					return err
+				}
+				if h != e.hash {
+					changes = append(changes, Change{path, Modified})
+					return nil
+				}
+			}
+
+			if info.Mode().Perm() != e.mode.Perm() {
+				changes = append(changes, Change{path, ModeChanged})
+			}
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for path := range archived {
+		if !seen[path] {
+			changes = append(changes, Change{path, Removed})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, archived, nil
+}
+
+func (sys *System) Status() (*WorkspaceStatus, error) {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	chk, err := sys.w.GetCheckout()
+	if err != nil {
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	version, hashes, err := sys.baseVersion()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	changes, _, err := sys.compareWorkspace(hashes, false)
+	if err != nil {
+		log.Errorf("Cannot compare workspace: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	status := &WorkspaceStatus{
+		CheckedOut: chk != "",
+		Version:    version,
+		Changes:    changes,
+		Update:     sys.updateStatus(),
+	}
+	if !status.CheckedOut {
+		if head, _, err := sys.s.getHead(); err == nil && head != version {
+			status.Head = head
+		}
+		status.Pin = sys.pinned()
+		if status.Pin != nil {
+			_, err := sys.s.getVersionHashes(status.Pin.Version)
+			status.PinPruned = GetErrorType(err) == UnknownVersion
+		}
+	}
+	if health := sys.Health(); sys.hooks.configured(HealthCheckHook) || len(health.Bad) > 0 {
+		status.Health = health
+	}
+	return status, nil
+}
+
+// Diff writes unified diffs of the changed text files in the workspace
+func (sys *System) Diff(w io.Writer) error {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	_, hashes, err := sys.baseVersion()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	changes, archived, err := sys.compareWorkspace(hashes, true)
+	if err != nil {
+		log.Errorf("Cannot compare workspace: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	for _, change := range changes {
+		var oldData, newData []byte
+		oldName, newName := "a/"+change.Path, "b/"+change.Path
+
+		e := archived[change.Path]
+		if change.Status == ModeChanged {
+			fmt.Fprintf(w, "mode %s: %s -> ", change.Path, e.mode.Perm())
+			if info, err := os.Stat(sys.w.getEntry(change.Path)); err == nil {
+				fmt.Fprintf(w, "%s\n", info.Mode().Perm())
+			} else {
+				fmt.Fprintf(w, "?\n")
+			}
+			continue
+		}
+
+		if e != nil {
+			if e.mode.IsDir() {
+				e = nil
+			} else if e.data == nil {
+				fmt.Fprintf(w, "Files %s and %s differ\n", oldName, newName)
+				continue
+			} else {
+				oldData = e.data
+			}
+		}
+		if e == nil {
+			oldName = "/dev/null"
+		}
+
+		info, err := os.Stat(sys.w.getEntry(change.Path))
+		if err != nil || info.IsDir() {
+			newName = "/dev/null"
+		} else if info.Size() > maxDiffSize {
+			fmt.Fprintf(w, "Files %s and %s differ\n", oldName, newName)
+			continue
+		} else if newData, err = ioutil.ReadFile(sys.w.getEntry(change.Path)); err != nil {
+			return NewOperationError(InternalError, err.Error())
+		}
+
+		if oldName == "/dev/null" && newName == "/dev/null" {
+			// directories
+			continue
+		}
+
+		if !isText(oldData) || !isText(newData) {
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+
+		if _, err := io.WriteString(w, unifiedDiff(oldName, newName, oldData, newData)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestSystem returns the system of a file on the file backend, with its
+// cache and workspace in temporary directories
+func newTestSystem(t *testing.T) *System {
+	backend, err := NewFileBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := backend.Open("/test.tgz", StorageOptions{Retention: HistoryRetention{Keep: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Cache{CacheDir: t.TempDir(), ChunkSize: 65536, Owner: "/test.tgz"}
+	if err := c.initCache(); err != nil {
+		t.Fatal(err)
+	}
+	return NewSystem(s, c, &Workspace{Root: filepath.Join(t.TempDir(), "ws")}, SystemOptions{})
+}
+
+// writeFiles writes files to the workspace; an empty content removes the
+// file
+func writeFiles(t *testing.T, sys *System, files map[string]string) {
+	for name, data := range files {
+		p := filepath.Join(sys.w.Root, name)
+		if data == "" {
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// commitFiles checks the workspace out, writes files to it and commits
+func commitFiles(t *testing.T, sys *System, files map[string]string) {
+	if err := sys.Edit(false, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, sys, files)
+	if err := sys.Commit(false, CommitInfo{Message: "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	sys := newTestSystem(t)
+	commitFiles(t, sys, map[string]string{
+		"a":     "a\n",
+		"b":     "b\n",
+		"dir/c": "c\n",
+		"dir/d": "d\n",
+	})
+
+	status, err := sys.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.CheckedOut || len(status.Changes) != 0 {
+		t.Fatalf("status after commit: %+v", status)
+	}
+
+	if err := sys.Edit(false, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, sys, map[string]string{
+		"a":     "changed\n",
+		"b":     "",
+		"dir/e": "e\n",
+	})
+	if err := os.Chmod(filepath.Join(sys.w.Root, "dir/c"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = sys.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{"a", Modified},
+		{"b", Removed},
+		{"dir/c", ModeChanged},
+		{"dir/e", Added},
+	}
+	if !status.CheckedOut || !reflect.DeepEqual(status.Changes, want) {
+		t.Errorf("status %+v, want changes %+v", status, want)
+	}
+
+	var diff strings.Builder
+	if err := sys.Diff(&diff); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"-a\n", "+changed\n", "-b\n", "+e\n"} {
+		if !strings.Contains(diff.String(), line) {
+			t.Errorf("diff lacks %q:\n%s", line, diff.String())
+		}
+	}
+}
@@ -2,155 +2,225 @@ package main
 
 import (
 	"fmt"
-	"github.com/gocql/gocql"
-	"strconv"
+	"regexp"
+	"strings"
 	"time"
+
+	"github.com/gocql/gocql"
 )
 
-type Storage struct {
-	Session *gocql.Session
-	File    string
+// ChunkStore keeps content addressed chunks. Chunks are shared by all
+// configuration files of a backend; chunks kept per file by older versions
+// are still read.
+type ChunkStore interface {
+	readChunk(h string) ([]byte, error)
+	writeChunk(h string, data []byte) error
+	// touchChunk marks a stored chunk as being used again and tells
+	// whether it exists
+	touchChunk(h string) (bool, error)
 }
 
-func (s *Storage) initStorage() error {
-	if err := s.Session.Query("CREATE KEYSPACE IF NOT EXISTS dconf WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 3 };").Exec(); err != nil {
-		return err
-	}
-	if err := s.Session.Query(`CREATE TABLE IF NOT EXISTS dconf.files (
-      entryname text,
-		  block     int,
-		  data      blob,
-		  hash      text,
-          PRIMARY KEY(entryname, block));`).Exec(); err != nil {
-		return err
-	}
-	return nil
+// chunkGracePeriod is the default time unreachable refs and chunks are
+// kept by the garbage collection; chunks are written and touched before
+// the ref using them is published
+const chunkGracePeriod = time.Hour
+
+// RefStore keeps the ordered list of chunk hashes making up the current
+// version of a configuration file together with the retained history
+type RefStore interface {
+	getHashes() ([]string, error)
+	// getHead returns the current version with its hash list; the version is
+	// empty if the file has never been committed with a ref
+	getHead() (string, []string, error)
+	// getHeadVersion returns the current version only; it is cheap enough
+	// to be polled
+	getHeadVersion() (string, error)
+	// setHashes makes hashes the current version if expected still is the
+	// current one and fails with CheckoutMismatch otherwise
+	setHashes(expected string, oldHashes, hashes []string, info CommitInfo, ph SetHashesProgressCallback) error
+	// listVersions returns the retained versions, newest (current) first
+	listVersions() ([]Version, error)
+	getVersionHashes(version string) ([]string, error)
 }
 
-func (s *Storage) getHashes() ([]string, error) {
-	var hash string
-	res := make([]string, 0)
-	var block int
+// CommitInfo describes a commit; Parent is filled in by the RefStore
+type CommitInfo struct {
+	Author  string `json:"author,omitempty"`
+	Message string `json:"message,omitempty"`
+	Parent  string `json:"parent,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	// Target lists the node labels the version is rolled out to; empty for
+	// all nodes
+	Target []string `json:"target,omitempty"`
+}
 
-	// v2: files[entryname=?,block=-1].hash points to a reference to a hash list
-	iter_v2 := s.Session.Query("SELECT hash FROM dconf.files WHERE entryname=? AND block=?;", s.File, -1).Iter()
-	for iter_v2.Scan(&hash) {
-		if err := iter_v2.Close(); err != nil {
-			return nil, err
-		}
+type Version struct {
+	Version string    `json:"version"`
+	Time    time.Time `json:"time"`
+	CommitInfo
+}
 
-		iter_v2_1 := s.Session.Query("SELECT block, hash FROM dconf.files WHERE entryname=?;", hash).PageSize(256).Iter()
-		for iter_v2_1.Scan(&block, &hash) {
-			res = set(res, block, hash)
+// HistoryRetention keeps the Keep most recent versions plus any version
+// younger than MaxAge. The versions nodes follow are always kept: the
+// current version, the newest one rolled out to all nodes, the newest one
+// for every label targeted since, and the versions nodes are pinned to.
+type HistoryRetention struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+// expired returns the versions (sorted newest first) falling outside of the
+// retention policy; pinned are the versions nodes are pinned to
+func (r HistoryRetention) expired(versions []Version, pinned map[string]bool, now time.Time) []Version {
+	res := make([]Version, 0)
+	// labels whose nodes follow a newer version, nil once a version
+	// rolled out to all nodes has been seen
+	followed := make(map[string]bool)
+	for i, v := range versions {
+		followedBy := false
+		if followed != nil {
+			followedBy = len(v.Target) == 0
+			for _, l := range v.Target {
+				followedBy = followedBy || !followed[l]
+				followed[l] = true
+			}
+			if len(v.Target) == 0 {
+				followed = nil
+			}
 		}
-		if err := iter_v2_1.Close(); err != nil {
-			return nil, err
+		if i == 0 || i < r.Keep || followedBy || pinned[v.Version] {
+			continue
 		}
-
-		return res, nil
-	}
-
-	if err := iter_v2.Close(); err != nil {
-		return nil, err
+		if r.MaxAge > 0 && now.Sub(v.Time) < r.MaxAge {
+			continue
+		}
+		res = append(res, v)
 	}
+	return res
+}
 
-	// v1: don't use indirect addressing of hash lists
-	iter := s.Session.Query("SELECT block, hash FROM dconf.files WHERE entryname=?;", s.File).PageSize(256).Iter()
+// Lease marks a file as being edited on one host of the cluster
+type Lease struct {
+	File    string    `json:"file"`
+	Host    string    `json:"host"`
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires"`
+}
 
-	for iter.Scan(&block, &hash) {
-		res = set(res, block, hash)
-	}
-	if err := iter.Close(); err != nil {
-		return nil, err
-	}
-	return res, nil
+// LeaseStore keeps the edit leases of a configuration file
+type LeaseStore interface {
+	// getLease returns the current lease or nil if there is none
+	getLease() (*Lease, error)
+	// acquireLease takes or renews the lease for l.Host and fails with
+	// Locked while another host holds it
+	acquireLease(l Lease, ttl time.Duration) error
+	// releaseLease drops the lease of host, or any lease if force is set
+	releaseLease(host string, force bool) error
 }
 
-type SetHashesProgressCallback func()
+// PinStore records the versions the nodes are pinned to, so that the
+// history retains them
+type PinStore interface {
+	// setPin records the version host is pinned to; an empty version
+	// removes the pin
+	setPin(host string, version string) error
+	// pinnedVersions returns the versions any host is pinned to
+	pinnedVersions() (map[string]bool, error)
+}
 
-func (s *Storage) setHashes(oldHashes, hashes []string, ph SetHashesProgressCallback) error {
-	now := time.Now()
-	new_ref := s.File + ":*" + strconv.FormatInt(now.Unix(), 10)
+type Storage interface {
+	ChunkStore
+	RefStore
+	LeaseStore
+	PinStore
+}
 
-	var old_ref string
-	var old_version bool = true
+type SetHashesProgressCallback func()
 
-	iter_v2 := s.Session.Query("SELECT hash FROM dconf.files WHERE entryname=? AND block=?;", s.File, -1).Iter()
-	for iter_v2.Scan(&old_ref) {
-		old_version = false
-	}
-	if err := iter_v2.Close(); err != nil {
-		log.Error("Error while trying to determine the storage version", err)
-		return err
-	}
+// StorageOptions configure the storage of a file
+type StorageOptions struct {
+	Retention HistoryRetention
+	// Consistency of Cassandra reads and writes; the level of the backend
+	// is used if it is zero
+	Consistency gocql.Consistency
+}
 
-	newHashes := make(map[string]bool)
+// StorageBackend opens the storage of individual configuration files
+type StorageBackend interface {
+	Open(file string, opts StorageOptions) (Storage, error)
+	// CollectGarbage finds the refs and chunks not reachable from the
+	// current ref or the retained history of any file and deletes the ones
+	// older than grace unless dryRun is set
+	CollectGarbage(grace time.Duration, dryRun bool) (*GCReport, error)
+	Close()
+}
 
-	for i := 0; i < len(hashes); i++ {
-		if err := s.Session.Query("INSERT INTO dconf.files(entryname, block, data, hash) VALUES (?,?,?,?);",
-			new_ref, i, make([]byte, 0), hashes[i]).Exec(); err != nil {
-			orig_err := err
-			s.Session.Query("DELETE FROM dconf.files WHERE entryname=?;", new_ref).Exec()
-			log.Errorf("Error trying to set block %d to hash %s for ref=%s: %v", i, hashes[i], new_ref, orig_err)
-			return orig_err
-		}
-		ph()
-		newHashes[hashes[i]] = true
-	}
+// keyspacePattern matches the Cassandra keyspace names accepted; the name
+// is put into CQL statements as is
+var keyspacePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+
+// StorageURI is a parsed storage backend URI
+type StorageURI struct {
+	Scheme string
+	// Hosts and Keyspace of a Cassandra backend
+	Hosts    []string
+	Keyspace string
+	// Dir of a file backend
+	Dir string
+}
 
-	if err := s.Session.Query("INSERT INTO dconf.files(entryname, block, data, hash) VALUES (?,?,?,?);",
-		s.File, -1, make([]byte, 0), new_ref).Exec(); err != nil {
-		orig_err := err
-		s.Session.Query("DELETE FROM dconf.files WHERE entryname=?;", new_ref).Exec()
-		log.Errorf("Error updating the ref to %s for entryname %s: %v", new_ref, s.File, orig_err)
-		return orig_err
+// ParseStorageURI parses a storage backend URI:
+//
+//	cassandra://host1,host2/keyspace
+//	file:///var/lib/dcd
+//
+// A bare host list is accepted as a Cassandra endpoint for compatibility.
+func ParseStorageURI(uri string) (*StorageURI, error) {
+	res := &StorageURI{Scheme: "cassandra"}
+	rest := uri
+	if p := strings.SplitN(uri, "://", 2); len(p) == 2 {
+		res.Scheme = p[0]
+		rest = p[1]
 	}
 
-	if old_version {
-		for i := len(hashes); i < len(oldHashes); i++ {
-			s.Session.Query("DELETE FROM dconf.files WHERE entryname=? AND block=?;", s.File, i).Exec()
-			ph()
+	switch res.Scheme {
+	case "cassandra":
+		hosts := rest
+		res.Keyspace = "dconf"
+		if p := strings.SplitN(rest, "/", 2); len(p) == 2 {
+			hosts = p[0]
+			if p[1] != "" {
+				res.Keyspace = p[1]
+			}
 		}
-	} else {
-		s.Session.Query("DELETE FROM dconf.files WHERE entryname=?;", old_ref).Exec()
-	}
-
-	for _, h := range oldHashes {
-		if _, ok := newHashes[h]; !ok {
-			s.Session.Query("DELETE FROM dconf.files WHERE entryname=?;", s.File+":"+h).Exec()
-			ph()
+		if hosts == "" {
+			return nil, fmt.Errorf("No cassandra hosts in %s", uri)
+		}
+		if !keyspacePattern.MatchString(res.Keyspace) {
+			return nil, fmt.Errorf("Invalid keyspace: %s", res.Keyspace)
+		}
+		res.Hosts = strings.Split(hosts, ",")
+	case "file":
+		if rest == "" {
+			return nil, fmt.Errorf("No directory in %s", uri)
 		}
+		res.Dir = rest
+	default:
+		return nil, fmt.Errorf("Unsupported storage backend: %s", uri)
 	}
-
-	//if err := s.Session.Query("DELETE FROM dconf.files WHERE entryname=?;", s.File).Exec(); err != nil {
-	//	return err
-	//}
-
-	//for i, h := range hashes {
-	//	if err := s.Session.Query("INSERT INTO dconf.files(entryname, block, data, hash) VALUES (?,?,?,?);", s.File, i, make([]byte, 0), h).Exec(); err != nil {
-	//		return err
-	//	}
-	//}
-
-	return nil
+	return res, nil
 }
 
-func (s *Storage) readChunk(h string) ([]byte, error) {
-	log.Debug("Storage:readChunk(%s)", h)
-	iter := s.Session.Query("SELECT data FROM dconf.files WHERE entryname=? AND block=0;", s.File+":"+h).Iter()
-	defer iter.Close()
-	var data []byte
-	for iter.Scan(&data) {
-		return data, nil
+// OpenStorageBackend connects to the backend identified by uri, see
+// ParseStorageURI
+func OpenStorageBackend(uri string, consistency gocql.Consistency) (StorageBackend, error) {
+	u, err := ParseStorageURI(uri)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("File %s: Chunk %s not found", s.File, h)
-}
-
-func (s *Storage) writeChunk(h string, data []byte) error {
-	log.Debug("Storage:writeChunk(%s,%d)", h, len(data))
-	if err := s.Session.Query("INSERT INTO dconf.files(entryname, block, data, hash) VALUES (?,?,?,?);", s.File+":"+h, 0, data, "").Exec(); err != nil {
-		return err
+	if u.Scheme == "file" {
+		return NewFileBackend(u.Dir)
 	}
-	return nil
+	return NewCassandraBackend(u.Hosts, u.Keyspace, consistency)
 }
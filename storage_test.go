@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStorageURI(t *testing.T) {
+	tests := []struct {
+		uri string
+		res *StorageURI
+	}{
+		{"cassandra://h1,h2/ks", &StorageURI{Scheme: "cassandra", Hosts: []string{"h1", "h2"}, Keyspace: "ks"}},
+		{"cassandra://h1/", &StorageURI{Scheme: "cassandra", Hosts: []string{"h1"}, Keyspace: "dconf"}},
+		{"h1,h2", &StorageURI{Scheme: "cassandra", Hosts: []string{"h1", "h2"}, Keyspace: "dconf"}},
+		{"localhost", &StorageURI{Scheme: "cassandra", Hosts: []string{"localhost"}, Keyspace: "dconf"}},
+		{"file:///var/lib/dcd", &StorageURI{Scheme: "file", Dir: "/var/lib/dcd"}},
+		{"cassandra:///ks", nil},
+		{"", nil},
+		{"file://", nil},
+		{"s3://bucket/dcd", nil},
+		{"cassandra://h1/ks;DROP KEYSPACE ks", nil},
+		{"cassandra://h1/1ks", nil},
+		{"cassandra://h1/a_very_long_keyspace_name_which_cassandra_rejects_", nil},
+	}
+	for _, test := range tests {
+		res, err := ParseStorageURI(test.uri)
+		if test.res == nil {
+			if err == nil {
+				t.Errorf("%s: parsed as %+v", test.uri, res)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(res, test.res) {
+			t.Errorf("%s: parsed as %+v, %v, want %+v", test.uri, res, err, test.res)
+		}
+	}
+}
+
+func TestOpenFileBackend(t *testing.T) {
+	backend, err := OpenStorageBackend("file://"+t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	if _, ok := backend.(*FileBackend); !ok {
+		t.Errorf("opened %T", backend)
+	}
+}
+
+func TestHistoryRetentionExpired(t *testing.T) {
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	versions := make([]Version, 5)
+	for i := range versions {
+		// newest first, a day apart
+		versions[i] = Version{Version: string(rune('e' - i)), Time: now.Add(-time.Duration(i) * 24 * time.Hour)}
+	}
+
+	tests := []struct {
+		name      string
+		retention HistoryRetention
+		expired   string
+	}{
+		{"keep none", HistoryRetention{}, "dcba"},
+		{"keep one", HistoryRetention{Keep: 1}, "dcba"},
+		{"keep three", HistoryRetention{Keep: 3}, "ba"},
+		{"keep all", HistoryRetention{Keep: 5}, ""},
+		{"keep more", HistoryRetention{Keep: 10}, ""},
+		{"young", HistoryRetention{Keep: 1, MaxAge: 60 * time.Hour}, "ba"},
+		{"young or recent", HistoryRetention{Keep: 4, MaxAge: 36 * time.Hour}, "a"},
+		{"all old", HistoryRetention{MaxAge: time.Hour}, "dcba"},
+	}
+	for _, test := range tests {
+		expired := ""
+		for _, v := range test.retention.expired(versions, nil, now) {
+			expired += v.Version
+		}
+		if expired != test.expired {
+			t.Errorf("%s: expired %q, want %q", test.name, expired, test.expired)
+		}
+	}
+}
+
+func TestHistoryRetentionFollowed(t *testing.T) {
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	// newest first
+	versions := []Version{
+		{Version: "f", CommitInfo: CommitInfo{Target: []string{"canary"}}},
+		{Version: "e", CommitInfo: CommitInfo{Target: []string{"eu", "canary"}}},
+		{Version: "d", CommitInfo: CommitInfo{Target: []string{"canary"}}},
+		{Version: "c"},
+		{Version: "b", CommitInfo: CommitInfo{Target: []string{"us"}}},
+		{Version: "a"},
+	}
+
+	tests := []struct {
+		name    string
+		pinned  map[string]bool
+		expired string
+	}{
+		{"followed", nil, "dba"},
+		{"pinned", map[string]bool{"a": true, "d": true}, "b"},
+		{"pinned unknown", map[string]bool{"x": true}, "dba"},
+	}
+	for _, test := range tests {
+		expired := ""
+		for _, v := range (HistoryRetention{Keep: 1}).expired(versions, test.pinned, now) {
+			expired += v.Version
+		}
+		if expired != test.expired {
+			t.Errorf("%s: expired %q, want %q", test.name, expired, test.expired)
+		}
+	}
+}
@@ -2,32 +2,63 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
-	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"sync"
 	"time"
 )
 
+type SystemOptions struct {
+	// LeaseTTL enables cluster-wide edit leases expiring after LeaseTTL
+	// unless renewed
+	LeaseTTL time.Duration
+	Hooks    HookOptions
+	// Validators are run by Commit before anything is stored
+	Validators []Validator
+	// Labels of the node; versions committed with a target are only rolled
+	// out to nodes carrying one of its labels until they are promoted
+	Labels []string
+	// Notifier, if set, tells peers about new versions
+	Notifier *Notifier
+	// UpdateInterval is the time between polls of the update loop; after
+	// failures it backs off up to MaxBackoff
+	UpdateInterval time.Duration
+	MaxBackoff     time.Duration
+}
+
 type System struct {
-	s    *Storage
-	c    *Cache
-	w    *Workspace
-	lock *sync.Mutex
+	s     Storage
+	c     *Cache
+	w     *Workspace
+	opts  SystemOptions
+	hooks *Hooks
+	lock  *sync.Mutex
+	// polled is the current version seen by the last successful poll
+	polled string
+	// rollout caches the version followed for the head seen last
+	rollout struct {
+		head    string
+		version string
+	}
+	loop updateLoop
 }
 
-func NewSystem(s *Storage, c *Cache, w *Workspace) *System {
+func NewSystem(s Storage, c *Cache, w *Workspace, opts SystemOptions) *System {
 	return &System{
-		s:    s,
-		c:    c,
-		w:    w,
-		lock: &sync.Mutex{},
+		s:     s,
+		c:     c,
+		w:     w,
+		opts:  opts,
+		hooks: NewHooks(c.Owner, w.Root, opts.Hooks),
+		lock:  &sync.Mutex{},
+		loop:  updateLoop{notify: make(chan struct{}, 1)},
 	}
 }
 
-func (sys *System) Edit(forceOverwrite bool, ph *ProgressHandler) error {
+func (sys *System) Edit(forceOverwrite bool, user string, ph *ProgressHandler) (err error) {
 	sys.lock.Lock()
 	defer sys.lock.Unlock()
 
@@ -42,8 +73,25 @@ func (sys *System) Edit(forceOverwrite bool, ph *ProgressHandler) error {
 		return NewOperationError(InternalError, err.Error())
 	}
 
+	if chk == "" || forceOverwrite {
+		if err := sys.acquireLease(user); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				sys.releaseLease()
+			}
+		}()
+	}
+
+	hashes, err := s.getHashes()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
 	if forceOverwrite {
-		hash, err = updateWorkspace(s, c, w, true, true, ph)
+		hash, err = updateWorkspace(s, c, w, sys.hooks, hashes, true, true, false, ph)
 		if err != nil {
 			log.Errorf("Cannot update workspace: %s", err.Error())
 			return NewOperationError(InternalError, err.Error())
@@ -55,7 +103,7 @@ func (sys *System) Edit(forceOverwrite bool, ph *ProgressHandler) error {
 		if chk != "" {
 			return NewOperationError(AlreadyCheckedOut, "The workspace has already been checked out")
 		}
-		hash, err = updateWorkspace(s, c, w, true, false, ph)
+		hash, err = updateWorkspace(s, c, w, sys.hooks, hashes, true, false, false, ph)
 		if err != nil {
 			log.Errorf("Cannot update workspace: %s", err.Error())
 			return NewOperationError(InternalError, err.Error())
@@ -75,7 +123,7 @@ func (sys *System) Edit(forceOverwrite bool, ph *ProgressHandler) error {
 	return nil
 }
 
-func (sys *System) Commit(forceOverwrite bool, ph *ProgressHandler) error {
+func (sys *System) Commit(forceOverwrite bool, info CommitInfo, ph *ProgressHandler) error {
 	sys.lock.Lock()
 	defer sys.lock.Unlock()
 
@@ -87,7 +135,7 @@ func (sys *System) Commit(forceOverwrite bool, ph *ProgressHandler) error {
 	c := sys.c
 	w := sys.w
 
-	hashes, err := s.getHashes()
+	version, hashes, err := s.getHead()
 	if err != nil {
 		log.Errorf("Cannot get hash list from DB: %s", err.Error())
 		return NewOperationError(InternalError, "Cannot get the hash list from DB")
@@ -104,161 +152,243 @@ func (sys *System) Commit(forceOverwrite bool, ph *ProgressHandler) error {
 			return NewOperationError(NotCheckedOut, "The workspace has not been checked out")
 		}
 
-		hash := sha256.New()
-		for _, h := range hashes {
-			b, err := parseHashStr(h)
-			if err != nil {
-				log.Errorf("Cannot parse hash: %s", h)
-				return NewOperationError(InternalError, "Cannot parse hash")
-			}
+		if err := sys.checkLease(); err != nil {
+			return err
+		}
 
-			hash.Write(b)
+		currentCheckout, err := contentHash(hashes)
+		if err != nil {
+			log.Errorf("Cannot parse hash: %s", err.Error())
+			return NewOperationError(InternalError, "Cannot parse hash")
 		}
 
-		currentCheckout := hashToStr(hash.Sum(make([]byte, 0)))
 		if currentCheckout != checkout {
 			return NewOperationError(CheckoutMismatch, "Workspace has been changed. Use -f to override")
 		}
 	}
 
-	piper, pipew := io.Pipe()
+	if err := sys.validate(); err != nil {
+		return err
+	}
 
-	gzipStream := gzip.NewWriter(pipew)
-	tarStream := tar.NewWriter(gzipStream)
+	var progress int64 = 0
 
-	go func() {
-		if err := w.Walk(func(path string, info os.FileInfo, r io.Reader, err error) error {
-			if err != nil {
-				return err
-			}
+	mw := newManifestWriter(s, c.ChunkSize, hashes, func() {
+		progress++
+		if ph != nil {
+			ph.SetProgress(progress)
+		}
+	})
 
-			if path == "." || path == ".dcd" {
-				return nil
-			}
+	if err := w.Walk(func(path string, info os.FileInfo, r io.Reader, err error) error {
+		if err != nil {
+			return err
+		}
 
-			header, err := tar.FileInfoHeader(info, "")
-			if err != nil {
-				return err
-			}
+		if path == "." || path == ".dcd" {
+			return nil
+		}
 
-			header.Name = path
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
 
-			if err := tarStream.WriteHeader(header); err != nil {
-				return err
-			}
+		header.Name = path
 
-			if !info.IsDir() {
-				if _, err := io.Copy(tarStream, r); err != nil {
-					pipew.CloseWithError(err)
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
-			log.Errorf("Error building archive: %s", err.Error())
+		mode, err := entryMode(header)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
 		}
-		log.Debug("Tarring finished, closing")
-		tarStream.Close()
-		gzipStream.Close()
-		pipew.Close()
-	}()
 
-	hash := sha256.New()
+		return mw.add(header, mode, r)
+	}); err != nil {
+		log.Errorf("Error building archive: %s", err.Error())
+		if GetErrorType(err) != UnknownErrorType {
+			return err
+		}
+		return NewOperationError(InternalError, err.Error())
+	}
 
-	var newHashes []string = make([]string, 0)
+	newHashes, err := mw.finish()
+	if err != nil {
+		return err
+	}
 
-	var progress int64 = 0
+	if err := sys.publish(version, hashes, newHashes, info, progress, ph); err != nil {
+		return err
+	}
 
-	buf := make([]byte, c.ChunkSize)
-	for {
-		hash.Reset()
-		n, err := io.ReadFull(piper, buf)
-		if err == nil {
-			log.Debug("Read full chunk (%d)", n)
-			chunk := buf
-			hash.Write(chunk)
-			h := hashToStr(hash.Sum(nil))
-			err2 := s.writeChunk(h, chunk)
-			if err2 != nil {
-				log.Errorf("Error writing chunk to DB: %s", err2.Error())
-				piper.CloseWithError(err2)
-				return NewOperationError(InternalError, err2.Error())
-			}
-			progress++
-			if ph != nil {
-				ph.SetProgress(progress)
-			}
-			newHashes = append(newHashes, h)
-		} else if err == io.ErrUnexpectedEOF {
-			// last chunk (incomplete)
-			log.Debug("Read partial chunk (%d)", n)
-			chunk := buf[0:n]
-			hash.Write(chunk)
-			log.Debug("Sum=%d", hash.Size())
-			h := hashToStr(hash.Sum(nil))
-			err2 := s.writeChunk(h, chunk)
-			if err2 != nil {
-				log.Errorf("Error writing chunk to DB: %s", err2.Error())
-				piper.CloseWithError(err2)
-				return NewOperationError(InternalError, err2.Error())
-			}
-			progress++
-			if ph != nil {
-				ph.SetProgress(progress)
+	w.RemoveCheckout()
+	sys.releaseLease()
+
+	if len(info.Target) > 0 {
+		// the node keeps the version rolled out to it
+		if _, nodeHashes, err := sys.nodeVersion(); err != nil {
+			log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		} else if nodeHashes != nil {
+			if _, err := updateWorkspace(s, c, w, sys.hooks, nodeHashes, true, true, false, nil); err != nil {
+				log.Errorf("Cannot update workspace: %s", err.Error())
 			}
-			newHashes = append(newHashes, h)
-			break
-		} else if err == io.EOF {
-			log.Debug("No more chunks")
-			// no more chunks
-			break
-		} else {
-			log.Errorf("Error writing chunk: %s", err.Error())
-			piper.CloseWithError(err)
+		}
+	}
+
+	//if err := w.MakeReadonly(); err != nil {
+	//	log.Errorf("Cannot make read-only: %s", err.Error())
+	//	return NewOperationError(InternalError, err.Error())
+	//}
+
+	return nil
+}
+
+// Put publishes a ready-made archive read from r as the new version. With
+// expected set the archive is only accepted if expected is still current.
+// Its files are checked by the syntax validators; exec validators need a
+// workspace, so put is refused when they are configured.
+func (sys *System) Put(r io.Reader, forceOverwrite bool, expected string, info CommitInfo, ph *ProgressHandler) error {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	if ph != nil {
+		ph.SetTotal(-1)
+	}
+
+	s := sys.s
+	c := sys.c
+	w := sys.w
+
+	version, hashes, err := s.getHead()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, "Cannot get the hash list from DB")
+	}
+
+	if expected != "" && expected != version {
+		return NewOperationError(CheckoutMismatch, "The file has been changed since version "+expected)
+	}
+
+	if !forceOverwrite {
+		checkout, err := w.GetCheckout()
+		if err != nil {
+			log.Errorf("Error getting checkout info: %s", err.Error())
 			return NewOperationError(InternalError, err.Error())
 		}
+
+		if checkout != "" {
+			return NewOperationError(AlreadyCheckedOut, "The workspace has been checked out. Use -f to override")
+		}
+
+		if err := sys.checkLease(); err != nil {
+			return err
+		}
 	}
 
-	log.Debugf("Setting new hashes (%d)", len(newHashes))
+	for _, v := range sys.opts.Validators {
+		if v.Command != "" {
+			return NewOperationError(InvalidRequest, fmt.Sprintf("Validator %s needs a workspace, use edit and commit instead", v))
+		}
+	}
+
+	// the archive is spooled so that it is validated in full before any of
+	// its chunks is stored
+	spool, err := ioutil.TempFile("", "dcd-put-")
+	if err != nil {
+		log.Errorf("Cannot create spool file: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if _, err := io.Copy(spool, r); err != nil {
+		log.Errorf("Cannot spool archive: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	failures := make([]string, 0)
+	if err := walkArchiveStream(spool, sys.checkEntries(func(*tar.Header, os.FileMode, io.Reader) error {
+		return nil
+	}, &failures)); err != nil {
+		if GetErrorType(err) != UnknownErrorType {
+			return err
+		}
+		return NewOperationError(InvalidRequest, "Not a valid gzip compressed tar archive: "+err.Error())
+	}
+	if err := validationFailed(failures); err != nil {
+		return err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return NewOperationError(InternalError, err.Error())
+	}
 
-	if err := s.setHashes(hashes, newHashes, func() {
+	var progress int64 = 0
+
+	mw := newManifestWriter(s, c.ChunkSize, hashes, func() {
+		progress++
 		if ph != nil {
-			progress++
 			ph.SetProgress(progress)
 		}
-	}); err != nil {
-		log.Errorf("Cannot update hash list: %s", err.Error())
+	})
+
+	if err := walkArchiveStream(spool, mw.add); err != nil {
+		if GetErrorType(err) != UnknownErrorType {
+			return err
+		}
+		log.Errorf("Cannot store archive: %s", err.Error())
 		return NewOperationError(InternalError, err.Error())
 	}
 
-	w.RemoveCheckout()
-
-	//if err := w.MakeReadonly(); err != nil {
-	//	log.Errorf("Cannot make read-only: %s", err.Error())
-	//	return NewOperationError(InternalError, err.Error())
-	//}
+	newHashes, err := mw.finish()
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return sys.publish(version, hashes, newHashes, info, progress, ph)
 }
 
-func (sys *System) Get(w io.Writer, ph *ProgressHandler) error {
+func (sys *System) Get(version string, w io.Writer, ph *ProgressHandler) error {
 	sys.lock.Lock()
 	defer sys.lock.Unlock()
 
 	s := sys.s
 
-	hashes, err := s.getHashes()
+	var hashes []string
+	var err error
+	if version == "" {
+		hashes, err = s.getHashes()
+	} else {
+		hashes, err = s.getVersionHashes(version)
+	}
 	if err != nil {
 		log.Errorf("Cannot get hash list from DB: %s", err.Error())
 		return err
 	}
 
+	var progress int64 = 0
+
+	m, err := readManifest(hashes, cachedChunkOpener(s, sys.c))
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if ph != nil {
+			ph.SetTotal(int64(len(m.Entries)))
+		}
+		return m.writeArchive(cachedChunkOpener(s, sys.c), w, func() {
+			progress++
+			if ph != nil {
+				ph.SetProgress(progress)
+			}
+		})
+	}
+
 	if ph != nil {
 		ph.SetTotal(int64(len(hashes)))
 	}
 
-	var progress int64 = 0
-
 	for _, h := range hashes {
 		bytes, err := s.readChunk(h)
 		if err != nil {
@@ -278,6 +408,111 @@ func (sys *System) Get(w io.Writer, ph *ProgressHandler) error {
 	return nil
 }
 
+func (sys *System) Log() ([]Version, error) {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	versions, err := sys.s.listVersions()
+	if err != nil {
+		log.Errorf("Cannot get version list from DB: %s", err.Error())
+		return nil, NewOperationError(InternalError, err.Error())
+	}
+
+	return versions, nil
+}
+
+// Rollback makes the content of an earlier version current again by
+// committing it as a new version
+func (sys *System) Rollback(version string, info CommitInfo, ph *ProgressHandler) error {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	if ph != nil {
+		ph.SetTotal(-1)
+	}
+
+	s := sys.s
+
+	current, hashes, err := s.getHead()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, "Cannot get the hash list from DB")
+	}
+
+	newHashes, err := s.getVersionHashes(version)
+	if err != nil {
+		if GetErrorType(err) == UnknownVersion {
+			return err
+		}
+		log.Errorf("Cannot get hash list of version %s from DB: %s", version, err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	if info.Message == "" {
+		info.Message = "Rollback to version " + version
+	}
+
+	if err := sys.publish(current, hashes, newHashes, info, 0, ph); err != nil {
+		return err
+	}
+
+	// the entries of the earlier version are older than the ones in the
+	// workspace; other nodes rewrite them as their content differs from the
+	// applied manifest, here they replace them whatever the format
+	_, nodeHashes, err := sys.nodeVersion()
+	if err != nil || !reflect.DeepEqual(nodeHashes, newHashes) {
+		return nil
+	}
+	if _, err := updateWorkspace(sys.s, sys.c, sys.w, sys.hooks, nodeHashes, true, false, true, nil); err != nil {
+		// the rollback stands, the update loop retries
+		log.Errorf("Cannot update workspace: %s", err.Error())
+	}
+	return nil
+}
+
+// publish makes newHashes the current version if version still is the
+// current one; hashes are the chunks of version
+func (sys *System) publish(version string, hashes, newHashes []string, info CommitInfo, progress int64, ph *ProgressHandler) error {
+	log.Debugf("Setting new hashes (%d)", len(newHashes))
+
+	var err error
+	info.Hash, err = contentHash(newHashes)
+	if err != nil {
+		log.Errorf("Cannot parse hash: %s", err.Error())
+		return NewOperationError(InternalError, "Cannot parse hash")
+	}
+
+	if err := sys.s.setHashes(version, hashes, newHashes, info, func() {
+		if ph != nil {
+			progress++
+			ph.SetProgress(progress)
+		}
+	}); err != nil {
+		log.Errorf("Cannot update hash list: %s", err.Error())
+		if GetErrorType(err) == CheckoutMismatch {
+			return err
+		}
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	sys.opts.Notifier.notify(sys.c.Owner)
+
+	if sys.hooks.configured(PostCommitHook) {
+		var oldHash string
+		if len(hashes) > 0 {
+			oldHash, _ = contentHash(hashes)
+		}
+		changed, err := changedPaths(hashes, newHashes, cachedChunkOpener(sys.s, sys.c))
+		if err != nil {
+			log.Errorf("Cannot list changed paths: %s", err.Error())
+		}
+		// the commit stands even if the hook fails
+		sys.hooks.run(PostCommitHook, oldHash, info.Hash, changed)
+	}
+
+	return nil
+}
+
 func (sys *System) Update(force bool, ph *ProgressHandler) error {
 	sys.lock.Lock()
 	defer sys.lock.Unlock()
@@ -286,24 +521,102 @@ func (sys *System) Update(force bool, ph *ProgressHandler) error {
 	c := sys.c
 	w := sys.w
 
-	if _, err := updateWorkspace(s, c, w, true, force, ph); err != nil {
+	version, hashes, err := sys.nodeVersion()
+	if err != nil {
+		log.Errorf("Cannot get hash list from DB: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+	if hashes == nil && sys.pinned() != nil {
+		return NewOperationError(InvalidRequest, fmt.Sprintf("Pinned version %s is no longer retained, unpin to update", version))
+	}
+	if hashes == nil {
+		return NewOperationError(InvalidRequest, "No version has been rolled out to this node")
+	}
+
+	if _, err := updateWorkspace(s, c, w, sys.hooks, hashes, true, force, false, ph); err != nil {
 		log.Errorf("Cannot update workspace: %s", err.Error())
 		return NewOperationError(InternalError, err.Error())
 	}
 
 	if force {
 		w.RemoveCheckout()
+		sys.releaseLease()
 	}
 
 	return nil
 }
 
-func updateWorkspace(s *Storage, c *Cache, w *Workspace, forceUnpack bool, replace bool, ph *ProgressHandler) (string, error) {
-	hashes, err := s.getHashes()
+// Revert abandons local changes and restores the committed contents. With
+// paths only those are restored and the workspace stays checked out.
+func (sys *System) Revert(paths []string, ph *ProgressHandler) error {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	s := sys.s
+	c := sys.c
+	w := sys.w
+
+	paths = cleanPaths(paths)
+	if len(paths) == 0 {
+		// the node goes back to the version rolled out to it
+		_, hashes, err := sys.nodeVersion()
+		if err != nil {
+			log.Errorf("Cannot get hash list from DB: %s", err.Error())
+			return NewOperationError(InternalError, err.Error())
+		}
+		if hashes == nil {
+			return NewOperationError(InvalidRequest, "No version has been rolled out to this node")
+		}
+
+		if _, err := updateWorkspace(s, c, w, sys.hooks, hashes, true, true, false, ph); err != nil {
+			log.Errorf("Cannot update workspace: %s", err.Error())
+			return NewOperationError(InternalError, err.Error())
+		}
+
+		w.RemoveCheckout()
+		sys.releaseLease()
+		return nil
+	}
+
+	// the paths are restored as they are in the version the workspace is
+	// based on, which the rest of the workspace still holds
+	_, hashes, err := sys.baseVersion()
 	if err != nil {
 		log.Errorf("Cannot get hash list from DB: %s", err.Error())
-		return "", err
+		return NewOperationError(InternalError, err.Error())
 	}
+
+	if ph != nil {
+		ph.SetTotal(int64(len(hashes)))
+	}
+
+	if err := c.claimChunks(hashes); err != nil {
+		log.Errorf("Cannot claim cached chunks: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	for i, h := range hashes {
+		if !c.hasChunk(h) {
+			if err := downloadChunk(s, c, h); err != nil {
+				log.Errorf("Cannot download chunk: %s", err.Error())
+				return NewOperationError(InternalError, err.Error())
+			}
+		}
+		if ph != nil {
+			ph.SetProgress(int64(i + 1))
+		}
+	}
+
+	if _, err := unpack(hashes, s, c, w, true, false, paths); err != nil {
+		log.Errorf("Cannot unpack: %s", err.Error())
+		return NewOperationError(InternalError, err.Error())
+	}
+
+	return nil
+}
+
+// updateWorkspace makes the workspace hold the version made of hashes
+func updateWorkspace(s Storage, c *Cache, w *Workspace, hooks *Hooks, hashes []string, forceUnpack bool, replace bool, older bool, ph *ProgressHandler) (string, error) {
 	hashSet := make(map[string]bool)
 	for _, h := range hashes {
 		hashSet[h] = true
@@ -322,19 +635,39 @@ func updateWorkspace(s *Storage, c *Cache, w *Workspace, forceUnpack bool, repla
 	//log.Debug("Have %d hashes in workspace", len(hashes))
 
 	var hashesToDownload int64 = 0
+	var hashesToClaim int64 = 0
 
 	for _, h := range hashes {
 		if _, ok := cachedHashSet[h]; !ok {
-			hashesToDownload++
+			hashesToClaim++
+			// the chunk may be cached for another file already
+			if !c.hasChunk(h) {
+				hashesToDownload++
+			}
 		}
 	}
 
 	var hashesToUnpack int64 = 0
 
-	if hashesToDownload > 0 || forceUnpack || len(hashes) != len(cachedHashes) {
+	if hashesToClaim > 0 || forceUnpack || len(hashes) != len(cachedHashes) {
 		hashesToUnpack = int64(len(hashes))
 	}
 
+	hash, err := contentHash(hashes)
+	if err != nil {
+		log.Errorf("Error parsing hash: %s", err.Error())
+		return "", err
+	}
+	var oldHash string
+	if len(cachedHashes) > 0 {
+		oldHash, _ = contentHash(cachedHashes)
+	}
+
+	if hashesToUnpack > 0 && !forceUnpack && isBad(c, hash) {
+		log.Debugf("Not updating to version %s which failed the health check", hash)
+		return oldHash, nil
+	}
+
 	var hashesToRemove int64 = 0
 
 	for _, h := range cachedHashes {
@@ -351,15 +684,20 @@ func updateWorkspace(s *Storage, c *Cache, w *Workspace, forceUnpack bool, repla
 
 	var progress int64 = 0
 
-	var needUpdate = false
+	if hashesToClaim > 0 {
+		if err := c.claimChunks(hashes); err != nil {
+			log.Errorf("Cannot claim cached chunks: %s", err.Error())
+			return "", err
+		}
+	}
+
 	for _, h := range hashes {
-		if _, ok := cachedHashSet[h]; !ok {
-			log.Debug("Need to download chunk %s", h)
+		if _, ok := cachedHashSet[h]; !ok && !c.hasChunk(h) {
+			log.Debugf("Need to download chunk %s", h)
 			if err := downloadChunk(s, c, h); err != nil {
 				log.Errorf("Cannot download chunk: %s", err.Error())
 				return "", err
 			}
-			needUpdate = true
 			progress++
 			if ph != nil {
 				ph.SetProgress(progress)
@@ -367,9 +705,36 @@ func updateWorkspace(s *Storage, c *Cache, w *Workspace, forceUnpack bool, repla
 		}
 	}
 
-	needUpdate = forceUnpack || needUpdate || len(hashes) != len(cachedHashes)
-	if needUpdate {
-		if err := unpack(hashes, c, w, replace); err != nil {
+	// unpack leaves a checked out workspace alone unless told to replace
+	chk, err := w.GetCheckout()
+	if err != nil {
+		log.Errorf("Cannot read checkout marker: %s", err.Error())
+		return "", err
+	}
+	skipUnpack := chk != "" && !replace
+
+	// hooks are run when the version changes or local changes are replaced,
+	// watchers are told about version changes only
+	var changed []string
+	runHooks := hashesToUnpack > 0 && !skipUnpack && (oldHash != hash || replace) &&
+		(hooks.configured(PreUpdateHook, PostUpdateHook, HealthCheckHook) || hooks.watched())
+	if runHooks {
+		changed, err = changedPaths(cachedHashes, hashes, cachedChunkOpener(s, c))
+		if err != nil {
+			log.Errorf("Cannot list changed paths: %s", err.Error())
+		}
+		if err := hooks.run(PreUpdateHook, oldHash, hash, changed); err != nil {
+			// the workspace keeps the cached version
+			if hashesToClaim > 0 {
+				c.releaseChunks(cachedHashes)
+			}
+			return "", err
+		}
+	}
+
+	applied := false
+	if hashesToUnpack > 0 {
+		if applied, err = unpack(hashes, s, c, w, replace, older, nil); err != nil {
 			log.Errorf("Cannot unpack: %s", err.Error())
 			return "", err
 		}
@@ -379,32 +744,63 @@ func updateWorkspace(s *Storage, c *Cache, w *Workspace, forceUnpack bool, repla
 		}
 	}
 
-	for _, h := range cachedHashes {
-		if _, ok := hashSet[h]; !ok {
-			if err := c.removeChunk(h); err != nil {
-				log.Errorf("Cannot remove chunk: %s", err.Error())
+	if runHooks {
+		hooks.run(PostUpdateHook, oldHash, hash, changed)
+		if applied && oldHash != hash {
+			hooks.emit(oldHash, hash, changed)
+		}
+	}
+
+	// versions not applied to the workspace are neither checked nor marked
+	if applied && forceUnpack {
+		// applied on request
+		if err := clearBad(c, hash); err != nil {
+			log.Errorf("Cannot update bad versions: %s", err.Error())
+		}
+	} else if applied && runHooks && hooks.configured(HealthCheckHook) {
+		if err := hooks.run(HealthCheckHook, oldHash, hash, changed); err != nil {
+			if err := markBad(c, hash); err != nil {
+				log.Errorf("Cannot mark version bad: %s", err.Error())
 			}
-			progress++
-			if ph != nil {
-				ph.SetProgress(progress)
+			if len(cachedHashes) == 0 {
+				log.Errorf("Version %s failed the health check, there is no previous version to restore", hash)
+			} else if chk != "" {
+				// local edits are never replaced to restore a version
+				log.Errorf("Version %s failed the health check, not restoring %s over the checked out workspace", hash, oldHash)
+			} else {
+				log.Errorf("Version %s failed the health check, restoring %s", hash, oldHash)
+				if _, err := unpack(cachedHashes, s, c, w, true, false, nil); err != nil {
+					log.Errorf("Cannot restore previous version: %s", err.Error())
+				} else {
+					hooks.restored()
+					hooks.run(PostUpdateHook, hash, oldHash, changed)
+					if oldHash != hash {
+						hooks.emit(hash, oldHash, changed)
+					}
+					// the chunks of the bad version are released below
+					hashes = cachedHashes
+					hash = oldHash
+				}
 			}
 		}
 	}
 
-	hash := sha256.New()
-	for _, h := range hashes {
-		b, err := parseHashStr(h)
+	if hashesToClaim > 0 || hashesToRemove > 0 {
+		removed, err := c.releaseChunks(hashes)
 		if err != nil {
-			log.Errorf("Error parsing hash: %s", h)
+			log.Errorf("Cannot release cached chunks: %s", err.Error())
 			return "", err
 		}
-		hash.Write(b)
+		progress += int64(removed)
+		if ph != nil {
+			ph.SetProgress(progress)
+		}
 	}
 
-	return hashToStr(hash.Sum(make([]byte, 0))), nil
+	return hash, nil
 }
 
-func downloadChunk(s *Storage, c *Cache, h string) error {
+func downloadChunk(s ChunkStore, c *Cache, h string) error {
 	data, err := s.readChunk(h)
 	if err != nil {
 		return err
@@ -413,84 +809,107 @@ func downloadChunk(s *Storage, c *Cache, h string) error {
 	return c.writeChunk(h, data)
 }
 
-func unpack(hashes []string, c *Cache, w *Workspace, replace bool) error {
+// unpack extracts the archive into the workspace; if paths are given only
+// entries at or below them are touched. It tells whether it wrote anything:
+// a checked out workspace is left alone unless replace is set.
+func unpack(hashes []string, s ChunkStore, c *Cache, w *Workspace, replace bool, older bool, paths []string) (bool, error) {
 	chk, err := w.GetCheckout()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if !replace && chk != "" {
 		log.Debug("Skipping unpack since the workspace has been checked out")
-		return nil
+		return false, nil
 	}
 
-	existingEntries := make(map[string]bool)
-
-	if len(hashes) > 0 {
-		log.Debug("Unpacking %d chunks", len(hashes))
-		var readers = make([]io.Reader, 0)
-		for _, h := range hashes {
-			f, err := c.openChunk(h)
-			if err != nil {
-				return err
-			}
-
-			defer f.Close()
-			readers = append(readers, f)
-		}
-
-		joinedStreams := io.MultiReader(readers...)
-
-		gzStream, err := gzip.NewReader(joinedStreams)
-		if err != nil {
-			return err
-		}
-
-		tarStream := tar.NewReader(gzStream)
+	open := cachedChunkOpener(s, c)
 
-		for {
-			header, err := tarStream.Next()
-			if err == io.EOF {
-				break
-			}
+	m, err := readManifest(hashes, open)
+	if err != nil {
+		return false, err
+	}
+	// a staged version directory would lose the checkout marker
+	if w.Atomic && len(paths) == 0 && chk == "" {
+		log.Debugf("Unpacking %d chunks into a new version directory", len(hashes))
+		return true, unpackStaged(hashes, open, m, c, w)
+	}
 
-			if header == nil {
-				return fmt.Errorf("Unexpected nil tar header")
-			}
+	if m != nil {
+		log.Debugf("Unpacking %d entries", len(m.Entries))
+		return true, unpackManifest(m, open, c, w, replace, older, paths)
+	}
 
-			var dir os.FileMode
-			if header.Typeflag == '5' {
-				dir = os.ModeDir
-			} else if header.Typeflag == 0 || header.Typeflag == '0' {
-				dir = 0
-			} else {
-				return fmt.Errorf("Unsupported header: %d", header.Typeflag)
-			}
+	existingEntries := make(map[string]bool)
 
-			existingEntries[header.Name] = true
-			if err := w.WriteEntry(header.Name, dir|os.FileMode(header.Mode&0777755), header.ModTime, tarStream, replace); err != nil {
-				return err
-			}
+	log.Debugf("Unpacking %d chunks", len(hashes))
+	if err := walkArchive(hashes, open, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		existingEntries[header.Name] = true
+		if !selectedPath(header.Name, paths) && !(mode.IsDir() && parentOfPaths(header.Name, paths)) {
+			return nil
 		}
+		return w.WriteEntry(header.Name, mode, header.ModTime, r, replace, older)
+	}); err != nil {
+		return false, err
 	}
 
 	w.RemoveAll(func(path string) bool {
 		_, ok := existingEntries[path]
-		return !ok
+		return !ok && selectedPath(path, paths)
 	})
 
-	return nil
+	if len(paths) == 0 {
+		setAppliedManifest(c, nil)
+	}
+
+	return true, nil
 }
 
-func (sys *System) runUpdate() {
+// poll updates the workspace unless the current version is the one seen by
+// the last successful poll; it is run by the update loop and when a peer
+// notifies about a new version
+func (sys *System) poll() error {
 	sys.lock.Lock()
 	defer sys.lock.Unlock()
 
+	if sys.loop.stopped {
+		return nil
+	}
+
+	err := sys.pollLocked()
+	sys.pollDone(err)
+	return err
+}
+
+func (sys *System) pollLocked() error {
 	s := sys.s
 	c := sys.c
 	w := sys.w
 
-	defer time.AfterFunc(5*time.Second, func() { sys.runUpdate() })
+	if chk, err := w.GetCheckout(); err == nil && chk != "" {
+		sys.renewLease()
+	}
 
-	updateWorkspace(s, c, w, false, false, nil)
+	head, err := s.getHeadVersion()
+	if err != nil {
+		log.Errorf("Cannot get current version of %s from DB: %s", c.Owner, err.Error())
+		return err
+	}
+	if head != "" && head == sys.polled {
+		return nil
+	}
+
+	_, hashes, err := sys.nodeVersion()
+	if err != nil {
+		log.Errorf("Cannot get hash list of %s from DB: %s", c.Owner, err.Error())
+		return err
+	}
+	if hashes != nil {
+		if _, err := updateWorkspace(s, c, w, sys.hooks, hashes, false, false, false, nil); err != nil {
+			log.Errorf("Cannot update workspace of %s: %s", c.Owner, err.Error())
+			return err
+		}
+	}
+	sys.polled = head
+	return nil
 }
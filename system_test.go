@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogRollback(t *testing.T) {
+	sys := newTestSystem(t)
+
+	for _, data := range []string{"1", "2", "3"} {
+		commitFiles(t, sys, map[string]string{"a": data})
+	}
+
+	versions, err := sys.Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("%d versions, want 3", len(versions))
+	}
+	for i, v := range versions[:2] {
+		if v.Parent != versions[i+1].Version {
+			t.Errorf("version %s has parent %q, want %s", v.Version, v.Parent, versions[i+1].Version)
+		}
+	}
+	first := versions[2].Version
+
+	if err := sys.Rollback("unknown", CommitInfo{}, nil); GetErrorType(err) != UnknownVersion {
+		t.Errorf("rollback to an unknown version: %v", err)
+	}
+
+	if err := sys.Rollback(first, CommitInfo{Author: "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err = sys.Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 {
+		t.Fatalf("%d versions after rollback, want 4", len(versions))
+	}
+	if v := versions[0]; v.Message != "Rollback to version "+first || v.Author != "test" {
+		t.Errorf("rollback committed as %+v", v.CommitInfo)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(sys.w.Root, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1" {
+		t.Errorf("workspace holds %q after rollback, want 1", data)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	sys := newTestSystem(t)
+	sys.s.(*FileStorage).Retention = HistoryRetention{Keep: 2}
+
+	for _, data := range []string{"1", "2", "3", "4"} {
+		commitFiles(t, sys, map[string]string{"a": data})
+	}
+
+	versions, err := sys.Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("%d versions retained, want 2", len(versions))
+	}
+	if _, err := sys.s.getVersionHashes(versions[1].Parent); GetErrorType(err) != UnknownVersion {
+		t.Errorf("expired version %s: %v", versions[1].Parent, err)
+	}
+}
+
+// readFiles returns the content of the regular files of the workspace
+func readFiles(t *testing.T, sys *System) map[string]string {
+	files := make(map[string]string)
+	// the trailing slash follows the root symlink of an atomic workspace
+	err := filepath.Walk(sys.w.Root+"/", func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(sys.w.Root, p)
+		if info.IsDir() || name == ".dcd" {
+			// .dcd is the checkout marker
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		files[name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestRevert(t *testing.T) {
+	committed := map[string]string{"a": "1", "b": "1", "dir/c": "1"}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		files   map[string]string
+		checked bool
+	}{
+		{"workspace", nil, committed, false},
+		{"file", []string{"a"}, map[string]string{"a": "1", "b": "2", "dir/c": "2", "d": "2"}, true},
+		{"dir", []string{"dir/"}, map[string]string{"a": "2", "b": "2", "dir/c": "1", "d": "2"}, true},
+		{"added", []string{"d", "b"}, map[string]string{"a": "2", "b": "1", "dir/c": "2"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sys := newTestSystem(t)
+			commitFiles(t, sys, committed)
+
+			if err := sys.Edit(false, "test", nil); err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, sys, map[string]string{"a": "2", "b": "2", "dir/c": "2", "d": "2"})
+
+			if err := sys.Revert(test.paths, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if files := readFiles(t, sys); !reflect.DeepEqual(files, test.files) {
+				t.Errorf("workspace holds %v, want %v", files, test.files)
+			}
+			chk, err := sys.w.GetCheckout()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (chk != "") != test.checked {
+				t.Errorf("checkout marker %q", chk)
+			}
+		})
+	}
+}
+
+// archive returns a gzip compressed tar archive of files; names ending in
+// a slash are directories
+func archive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			header = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPut(t *testing.T) {
+	sys := newTestSystem(t)
+	sys.opts.Validators = []Validator{{Check: "json", Patterns: []string{"*.json"}}}
+	commitFiles(t, sys, map[string]string{"a.json": "{}"})
+
+	versions, err := sys.Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := versions[0].Version
+
+	chunks := func() int {
+		names, err := ioutil.ReadDir(sys.s.(*FileStorage).sharedChunkPath(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names)
+	}
+	stored := chunks()
+
+	plain := archive(t, map[string]string{"a.json": "[]"})
+	gz, _ := gzip.NewReader(bytes.NewReader(plain))
+	tarOnly, _ := ioutil.ReadAll(gz)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+		err      int
+	}{
+		{"not an archive", []byte("not an archive"), "", InvalidRequest},
+		{"not compressed", tarOnly, "", InvalidRequest},
+		{"invalid", archive(t, map[string]string{"a.json": "{", "b": "new"}), "", ValidationFailed},
+		{"stale", archive(t, map[string]string{"a.json": "[]"}), "1", CheckoutMismatch},
+	}
+	for _, test := range tests {
+		err := sys.Put(bytes.NewReader(test.data), false, test.expected, CommitInfo{}, nil)
+		if GetErrorType(err) != test.err {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+		if n := chunks(); n != stored {
+			t.Errorf("%s: %d chunks stored, want %d", test.name, n, stored)
+		}
+	}
+
+	data := archive(t, map[string]string{"a.json": "[]", "b": "new"})
+	if err := sys.Put(bytes.NewReader(data), false, current, CommitInfo{Message: "put"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = sys.Log()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Parent != current || versions[0].Message != "put" {
+		t.Fatalf("history after put: %+v", versions)
+	}
+
+	var got bytes.Buffer
+	if err := sys.Get("", &got, nil); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	if err := walkArchiveStream(&got, func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		files[header.Name] = string(data)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a.json": "[]", "b": "new"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("current version holds %v, want %v", files, want)
+	}
+}
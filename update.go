@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultUpdateInterval = 5 * time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+)
+
+// UpdateStatus reports the update loop of a file
+type UpdateStatus struct {
+	Interval    time.Duration `json:"interval"`
+	LastSuccess *time.Time    `json:"lastSuccess,omitempty"`
+	LastError   string        `json:"lastError,omitempty"`
+	// LastErrorTime is kept after the loop recovers
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+	// Failures counts the polls failed in a row
+	Failures int        `json:"failures"`
+	NextPoll *time.Time `json:"nextPoll,omitempty"`
+}
+
+// updateLoop is the state of the update loop, guarded by the system lock
+type updateLoop struct {
+	status UpdateStatus
+	// notify holds a pending request to poll at once
+	notify  chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	stopped bool
+}
+
+// interval returns the poll interval and the longest backoff of the file
+func (sys *System) interval() (time.Duration, time.Duration) {
+	interval := sys.opts.UpdateInterval
+	if interval <= 0 {
+		interval = defaultUpdateInterval
+	}
+	maxBackoff := sys.opts.MaxBackoff
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+	return interval, maxBackoff
+}
+
+// backoff returns the delay before the next poll after failures polls failed
+// in a row: the interval doubled for every failure up to maxBackoff, of
+// which a random half is taken so that nodes do not retry in lockstep
+func backoff(interval time.Duration, maxBackoff time.Duration, failures int) time.Duration {
+	if failures == 0 {
+		return interval
+	}
+	d := interval
+	for i := 0; i < failures && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// pollDone records the outcome of a poll
+func (sys *System) pollDone(err error) {
+	now := time.Now()
+	status := &sys.loop.status
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		status.LastErrorTime = &now
+	} else {
+		status.Failures = 0
+		status.LastSuccess = &now
+	}
+}
+
+// startUpdates polls once and then keeps polling in the background until
+// Stop is called
+func (sys *System) startUpdates() {
+	sys.poll()
+
+	sys.loop.stop = make(chan struct{})
+	sys.loop.done = make(chan struct{})
+	go sys.runUpdates()
+}
+
+func (sys *System) runUpdates() {
+	defer close(sys.loop.done)
+
+	interval, maxBackoff := sys.interval()
+	for {
+		sys.lock.Lock()
+		failures := sys.loop.status.Failures
+		delay := backoff(interval, maxBackoff, failures)
+		next := time.Now().Add(delay)
+		sys.loop.status.NextPoll = &next
+		sys.lock.Unlock()
+
+		if failures > 0 {
+			log.Errorf("Update of %s failed %d times in a row, retrying in %s", sys.c.Owner, failures, delay.Round(time.Millisecond))
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-sys.loop.notify:
+			timer.Stop()
+		case <-sys.loop.stop:
+			timer.Stop()
+			return
+		}
+
+		sys.poll()
+	}
+}
+
+// notified makes the update loop poll at once; notifications arriving
+// while one is pending are merged into it
+func (sys *System) notified() {
+	select {
+	case sys.loop.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends the update loop and waits for the operation in progress, if
+// any; later polls are ignored
+func (sys *System) Stop() {
+	sys.lock.Lock()
+	if sys.loop.stopped {
+		sys.lock.Unlock()
+		return
+	}
+	sys.loop.stopped = true
+	sys.loop.status.NextPoll = nil
+	sys.lock.Unlock()
+
+	if sys.loop.stop != nil {
+		close(sys.loop.stop)
+		<-sys.loop.done
+	}
+}
+
+// UpdateStatus returns the state of the update loop
+func (sys *System) UpdateStatus() *UpdateStatus {
+	sys.lock.Lock()
+	defer sys.lock.Unlock()
+
+	return sys.updateStatus()
+}
+
+// updateStatus returns the state of the update loop
+func (sys *System) updateStatus() *UpdateStatus {
+	status := sys.loop.status
+	status.Interval, _ = sys.interval()
+	return &status
+}
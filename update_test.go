@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		min      time.Duration
+		max      time.Duration
+	}{
+		{0, 5 * time.Second, 5 * time.Second},
+		{1, 5 * time.Second, 10 * time.Second},
+		{2, 10 * time.Second, 20 * time.Second},
+		{5, 80 * time.Second, 160 * time.Second},
+		{7, 150 * time.Second, 300 * time.Second},
+		{1000, 150 * time.Second, 300 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			d := backoff(5*time.Second, 5*time.Minute, test.failures)
+			if d < test.min || d > test.max {
+				t.Fatalf("%d failures: backoff %s, want %s to %s", test.failures, d, test.min, test.max)
+			}
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"path"
+	"strings"
 )
 
 func set(s []string, index int, value string) []string {
@@ -40,3 +43,79 @@ func parseHashStr(s string) ([]byte, error) {
 	}
 	return res, nil
 }
+
+// contentHash identifies a version by the hash of its chunk hashes
+func contentHash(hashes []string) (string, error) {
+	hash := sha256.New()
+	for _, h := range hashes {
+		b, err := parseHashStr(h)
+		if err != nil {
+			return "", fmt.Errorf("Cannot parse hash: %s", h)
+		}
+		hash.Write(b)
+	}
+
+	return hashToStr(hash.Sum(make([]byte, 0))), nil
+}
+
+// cleanPaths turns paths into clean paths relative to the workspace root
+func cleanPaths(paths []string) []string {
+	res := make([]string, 0, len(paths))
+	for _, p := range paths {
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if p == "" {
+			// the whole workspace
+			return nil
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// selectedPath tells whether name is one of paths or below one of them; all
+// names are selected by empty paths
+func selectedPath(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parentOfPaths tells whether name is a parent directory of one of paths
+func parentOfPaths(name string, paths []string) bool {
+	for _, p := range paths {
+		if strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CorruptChunkError reports chunk data not matching the hash it is stored
+// under
+type CorruptChunkError struct {
+	Hash string
+}
+
+func (e *CorruptChunkError) Error() string {
+	return fmt.Sprintf("Chunk %s is corrupt", e.Hash)
+}
+
+func isCorruptChunk(err error) bool {
+	_, ok := err.(*CorruptChunkError)
+	return ok
+}
+
+// verifyChunk checks data against the hash it is stored under
+func verifyChunk(h string, data []byte) error {
+	sum := sha256.Sum256(data)
+	if hashToStr(sum[:]) != h {
+		return &CorruptChunkError{Hash: h}
+	}
+	return nil
+}
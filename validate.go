@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Validator checks the workspace before a commit. Either Command is run by
+// sh with DCD_FILE and DCD_WORKSPACE set and has to exit with status 0, or
+// the files matching Patterns have to parse as Check (json, yaml or toml).
+// A pattern without a slash matches the base name of files at any depth,
+// other patterns the path relative to the workspace root.
+type Validator struct {
+	Command  string
+	Check    string
+	Patterns []string
+}
+
+// parseValidator parses exec:<command> or <check>:<pattern>[,<pattern>...]
+func parseValidator(spec string) (Validator, error) {
+	kv := strings.SplitN(spec, ":", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return Validator{}, fmt.Errorf("Invalid validator: %s", spec)
+	}
+
+	switch kv[0] {
+	case "exec":
+		return Validator{Command: kv[1]}, nil
+	case "json", "yaml", "toml":
+		patterns := strings.Split(kv[1], ",")
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return Validator{}, fmt.Errorf("Invalid pattern %s: %s", p, err.Error())
+			}
+		}
+		return Validator{Check: kv[0], Patterns: patterns}, nil
+	}
+	return Validator{}, fmt.Errorf("Unknown validator: %s", kv[0])
+}
+
+func (v Validator) String() string {
+	if v.Command != "" {
+		return "exec:" + v.Command
+	}
+	return v.Check + ":" + strings.Join(v.Patterns, ",")
+}
+
+func (v Validator) matches(name string) bool {
+	for _, p := range v.Patterns {
+		target := name
+		if !strings.Contains(p, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSyntax parses data in the given format
+func checkSyntax(format string, data []byte) error {
+	var v interface{}
+	switch format {
+	case "json":
+		return json.Unmarshal(data, &v)
+	case "yaml":
+		// a file may hold several documents
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			if err := dec.Decode(&v); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	case "toml":
+		_, err := toml.Decode(string(data), &v)
+		return err
+	}
+	return fmt.Errorf("Unknown format: %s", format)
+}
+
+// validate runs every validator on the workspace; the output of the failed
+// ones is returned in a ValidationFailed error
+func (sys *System) validate() error {
+	failures := make([]string, 0)
+
+	for _, v := range sys.opts.Validators {
+		if v.Command != "" {
+			output, _, err := runCommand(v.Command, []string{
+				"DCD_FILE=" + sys.c.Owner,
+				"DCD_WORKSPACE=" + sys.w.Root,
+			}, sys.opts.Hooks.Timeout)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s\n%s", v, err.Error(), strings.TrimRight(output, "\n")))
+			}
+			continue
+		}
+
+		if err := sys.w.Walk(func(path string, info os.FileInfo, r io.Reader, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || !v.matches(path) {
+				return nil
+			}
+
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if err := checkSyntax(v.Check, data); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: invalid %s: %s", path, v.Check, err.Error()))
+			}
+			return nil
+		}); err != nil {
+			log.Errorf("Cannot validate workspace: %s", err.Error())
+			return NewOperationError(InternalError, err.Error())
+		}
+	}
+
+	return validationFailed(failures)
+}
+
+// checkEntries wraps f so that the regular files of an archive are checked
+// by the syntax validators before f stores them; the failures are appended
+// to failures. Exec validators need a workspace and are not run.
+func (sys *System) checkEntries(f ArchiveWalkFunc, failures *[]string) ArchiveWalkFunc {
+	return func(header *tar.Header, mode os.FileMode, r io.Reader) error {
+		checks := make([]Validator, 0)
+		for _, v := range sys.opts.Validators {
+			if v.Command == "" && mode.IsRegular() && v.matches(header.Name) {
+				checks = append(checks, v)
+			}
+		}
+		if len(checks) == 0 {
+			return f(header, mode, r)
+		}
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		for _, v := range checks {
+			if err := checkSyntax(v.Check, data); err != nil {
+				*failures = append(*failures, fmt.Sprintf("%s: invalid %s: %s", header.Name, v.Check, err.Error()))
+			}
+		}
+		return f(header, mode, bytes.NewReader(data))
+	}
+}
+
+// validationFailed returns a ValidationFailed error listing failures, nil if
+// there are none
+func validationFailed(failures []string) error {
+	if len(failures) > 0 {
+		log.Infof("Commit rejected:\n%s", strings.Join(failures, "\n"))
+		return NewOperationError(ValidationFailed, "Validation failed:\n"+strings.Join(failures, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValidator(t *testing.T) {
+	tests := []struct {
+		spec string
+		v    Validator
+		ok   bool
+	}{
+		{"exec:make check", Validator{Command: "make check"}, true},
+		{"exec:a:b", Validator{Command: "a:b"}, true},
+		{"json:*.json", Validator{Check: "json", Patterns: []string{"*.json"}}, true},
+		{"yaml:*.yml,conf/*.yaml", Validator{Check: "yaml", Patterns: []string{"*.yml", "conf/*.yaml"}}, true},
+		{"toml:*.toml", Validator{Check: "toml", Patterns: []string{"*.toml"}}, true},
+		{"exec:", Validator{}, false},
+		{"json", Validator{}, false},
+		{"xml:*.xml", Validator{}, false},
+		{"json:[", Validator{}, false},
+	}
+	for _, test := range tests {
+		v, err := parseValidator(test.spec)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.spec, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(v, test.v) {
+			t.Errorf("%s: parsed %+v, want %+v", test.spec, v, test.v)
+		}
+		if test.ok && v.String() != test.spec {
+			t.Errorf("%s: printed as %s", test.spec, v.String())
+		}
+	}
+}
+
+func TestValidatorMatches(t *testing.T) {
+	v := Validator{Check: "yaml", Patterns: []string{"*.yml", "conf/*.yaml"}}
+	tests := []struct {
+		path  string
+		match bool
+	}{
+		{"a.yml", true},
+		{"deep/dir/a.yml", true},
+		{"conf/a.yaml", true},
+		{"other/conf/a.yaml", false},
+		{"a.yaml", false},
+		{"a.yml.bak", false},
+	}
+	for _, test := range tests {
+		if v.matches(test.path) != test.match {
+			t.Errorf("%s: match %v, want %v", test.path, !test.match, test.match)
+		}
+	}
+}
+
+func TestCheckSyntax(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		ok     bool
+	}{
+		{"json", `{"a": [1, 2]}`, true},
+		{"json", `{"a": }`, false},
+		{"yaml", "a: 1\n---\nb: 2\n", true},
+		{"yaml", "a: [1\n", false},
+		{"toml", "a = 1\n[b]\nc = \"d\"\n", true},
+		{"toml", "a = \n", false},
+		{"ini", "a=1", false},
+	}
+	for _, test := range tests {
+		if err := checkSyntax(test.format, []byte(test.data)); (err == nil) != test.ok {
+			t.Errorf("%s %q: error %v", test.format, test.data, err)
+		}
+	}
+}
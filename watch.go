@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPendingEvents limits the events queued for a watcher; a watcher which
+// falls further behind is disconnected
+const maxPendingEvents = 16
+
+// UpdateEvent tells watchers that a new version has been applied to the
+// workspace
+type UpdateEvent struct {
+	File    string    `json:"file"`
+	OldHash string    `json:"old_hash,omitempty"`
+	NewHash string    `json:"new_hash"`
+	Changed []string  `json:"changed"`
+	Time    time.Time `json:"time"`
+}
+
+// watchers is the set of watchers of a workspace
+type watchers struct {
+	lock *sync.Mutex
+	set  map[chan *UpdateEvent]struct{}
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		lock: &sync.Mutex{},
+		set:  make(map[chan *UpdateEvent]struct{}),
+	}
+}
+
+// watch registers a watcher; the channel is closed when the watcher is
+// cancelled or falls behind
+func (h *Hooks) watch() (<-chan *UpdateEvent, func()) {
+	ws := h.watchers
+	ch := make(chan *UpdateEvent, maxPendingEvents)
+
+	ws.lock.Lock()
+	ws.set[ch] = struct{}{}
+	ws.lock.Unlock()
+
+	return ch, func() {
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+		if _, ok := ws.set[ch]; ok {
+			delete(ws.set, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeAll disconnects all watchers
+func (ws *watchers) closeAll() {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	for ch := range ws.set {
+		delete(ws.set, ch)
+		close(ch)
+	}
+}
+
+// watched tells whether anybody watches the workspace
+func (h *Hooks) watched() bool {
+	if h == nil {
+		return false
+	}
+	h.watchers.lock.Lock()
+	defer h.watchers.lock.Unlock()
+	return len(h.watchers.set) > 0
+}
+
+// emit sends an event to all watchers without waiting for them
+func (h *Hooks) emit(oldHash string, newHash string, changed []string) {
+	if h == nil {
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	event := &UpdateEvent{
+		File:    h.file,
+		OldHash: oldHash,
+		NewHash: newHash,
+		Changed: changed,
+		Time:    time.Now(),
+	}
+
+	ws := h.watchers
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	for ch := range ws.set {
+		select {
+		case ch <- event:
+		default:
+			log.Errorf("Watcher of %s falls behind, disconnecting it", h.file)
+			delete(ws.set, ch)
+			close(ch)
+		}
+	}
+}
+
+// Watch calls f with every update applied to the workspace until done is
+// closed or f fails
+func (sys *System) Watch(done <-chan struct{}, f func(*UpdateEvent) error) error {
+	events, cancel := sys.hooks.watch()
+	defer cancel()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return NewOperationError(InternalError, "Watcher disconnected")
+			}
+			if err := f(event); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// runOnEvent runs args with the event in DCD_FILE, DCD_OLD_HASH,
+// DCD_NEW_HASH and DCD_CHANGED
+func runOnEvent(args []string, event *UpdateEvent) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"DCD_FILE="+event.File,
+		"DCD_OLD_HASH="+event.OldHash,
+		"DCD_NEW_HASH="+event.NewHash,
+		"DCD_CHANGED="+strings.Join(event.Changed, "\n"),
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchDisconnect(t *testing.T) {
+	sys := newTestSystem(t)
+	repos := NewRepos(nil, "")
+	repos.systems["/test.tgz"] = sys
+	srv := httptest.NewServer(NewHttpServerUnixSocket("", repos, nil))
+	defer srv.Close()
+
+	watch := func() *http.Response {
+		req, err := http.NewRequest("WATCH", srv.URL+"/test.tgz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// waitWatched emits events until the workspace is watched or not
+	waitWatched := func(want bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for sys.hooks.watched() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("watched stays %v", !want)
+			}
+			sys.hooks.emit("a", "b", nil)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the watcher goes away without reading; writing to its connection
+	// fails and the daemon drops it
+	resp := watch()
+	waitWatched(true)
+	resp.Body.Close()
+	waitWatched(false)
+
+	// the workspace can be watched again
+	resp = watch()
+	defer resp.Body.Close()
+	waitWatched(true)
+	sys.hooks.emit("b", "c", []string{"x"})
+	dec := json.NewDecoder(resp.Body)
+	var event UpdateEvent
+	for event.NewHash != "c" {
+		if err := dec.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(event.Changed) != 1 || event.Changed[0] != "x" {
+		t.Errorf("changed %v, want [x]", event.Changed)
+	}
+}
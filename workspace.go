@@ -11,12 +11,39 @@ import (
 
 type Workspace struct {
 	Root string
+	// Atomic makes updates switch the whole workspace at once, see swap
+	Atomic bool
+	// Owner, if set, is given the entries written
+	Owner *Ownership
+}
+
+// Ownership of workspace entries; -1 leaves the user or group unchanged
+type Ownership struct {
+	Uid int
+	Gid int
+}
+
+// chown gives an entry to the owner of the workspace
+func (w *Workspace) chown(filePath string) error {
+	if w.Owner == nil {
+		return nil
+	}
+	return os.Lchown(filePath, w.Owner.Uid, w.Owner.Gid)
 }
 
 func (w *Workspace) getEntry(name string) string {
 	return path.Join(w.Root, name)
 }
 
+// dir returns the directory holding the entries; in atomic mode the root
+// is a symlink to it
+func (w *Workspace) dir() string {
+	if dir, err := filepath.EvalSymlinks(w.Root); err == nil {
+		return dir
+	}
+	return w.Root
+}
+
 func (w *Workspace) checkoutMarker() string {
 	return path.Join(w.Root, ".dcd")
 }
@@ -42,7 +69,18 @@ func (w *Workspace) writeRegFile(filePath string, mode os.FileMode, modTime time
 	return nil
 }
 
-func (w *Workspace) WriteEntry(name string, mode os.FileMode, modTime time.Time, r io.Reader, replace bool) error {
+// outdated tells whether an existing entry is to be replaced by the archived
+// one, which is the case when the archived one is newer. With older, as when
+// rolling back, any other time will do; archive times have a resolution of
+// one second.
+func outdated(info os.FileInfo, modTime time.Time, older bool) bool {
+	if older {
+		return !info.ModTime().Truncate(time.Second).Equal(modTime.Truncate(time.Second))
+	}
+	return info.ModTime().Before(modTime)
+}
+
+func (w *Workspace) WriteEntry(name string, mode os.FileMode, modTime time.Time, r io.Reader, replace bool, older bool) error {
 	os.MkdirAll(w.Root, 0755)
 	filePath := w.getEntry(name)
 	info, err := os.Stat(filePath)
@@ -63,7 +101,7 @@ func (w *Workspace) WriteEntry(name string, mode os.FileMode, modTime time.Time,
 					return err
 				}
 			} else {
-				if info.ModTime().Before(modTime) || replace {
+				if outdated(info, modTime, older) || replace {
 					os.RemoveAll(filePath)
 					if err := w.writeRegFile(filePath, mode|0600, modTime, r); err != nil {
 						return err
@@ -74,7 +112,7 @@ func (w *Workspace) WriteEntry(name string, mode os.FileMode, modTime time.Time,
 			}
 		} else {
 			if mode.IsDir() {
-				if info.ModTime().Before(modTime) || replace {
+				if outdated(info, modTime, older) || replace {
 					os.RemoveAll(filePath)
 					if err := os.MkdirAll(filePath, mode|0700); err != nil {
 						return err
@@ -83,7 +121,7 @@ func (w *Workspace) WriteEntry(name string, mode os.FileMode, modTime time.Time,
 					// pass
 				}
 			} else {
-				if info.ModTime().Before(modTime) || replace {
+				if outdated(info, modTime, older) || replace {
 					if err := w.writeRegFile(filePath, mode|0600, modTime, r); err != nil {
 						return err
 					}
@@ -94,7 +132,7 @@ func (w *Workspace) WriteEntry(name string, mode os.FileMode, modTime time.Time,
 		}
 	}
 
-	return nil
+	return w.chown(filePath)
 }
 
 type RemoveFilterFunc func(string) bool
@@ -104,8 +142,9 @@ func (w *Workspace) Remove(name string) {
 }
 
 func (w *Workspace) RemoveAll(f RemoveFilterFunc) {
-	filepath.Walk(w.Root, func(name string, info os.FileInfo, err error) error {
-		filePath, err := filepath.Rel(w.Root, name)
+	root := w.dir()
+	filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		filePath, err := filepath.Rel(root, name)
 		if err != nil {
 			panic(err.Error())
 		}
@@ -153,8 +192,9 @@ func (w *Workspace) RemoveCheckout() error {
 type WalkFunc func(path string, info os.FileInfo, r io.Reader, err error) error
 
 func (w *Workspace) Walk(f WalkFunc) error {
-	return filepath.Walk(w.Root, func(path string, info os.FileInfo, err error) error {
-		filePath, err := filepath.Rel(w.Root, path)
+	root := w.dir()
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		filePath, err := filepath.Rel(root, path)
 		if err != nil {
 			panic(err.Error())
 		}
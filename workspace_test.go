@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteEntry(t *testing.T) {
+	archived := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		existing time.Time
+		replace  bool
+		older    bool
+		written  bool
+	}{
+		{"newer archived", archived.Add(-time.Hour), false, false, true},
+		{"same time", archived, false, false, false},
+		{"local edit", archived.Add(time.Hour), false, false, false},
+		{"local edit replaced", archived.Add(time.Hour), true, false, true},
+		{"rollback", archived.Add(time.Hour), false, true, true},
+		{"rollback same time", archived.Add(500 * time.Millisecond), false, true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &Workspace{Root: t.TempDir()}
+			p := filepath.Join(w.Root, "a")
+			if err := ioutil.WriteFile(p, []byte("existing"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, test.existing, test.existing); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.WriteEntry("a", 0644, archived, strings.NewReader("archived"), test.replace, test.older); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written := string(data) == "archived"; written != test.written {
+				t.Errorf("written = %v, want %v", written, test.written)
+			}
+		})
+	}
+}